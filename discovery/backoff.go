@@ -0,0 +1,190 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+)
+
+// BackoffPolicy decides how long to wait before retrying failed service registration or TTL update.
+// Implementations must be safe for concurrent use.
+type BackoffPolicy interface {
+	// NextDelay returns the delay before given retry attempt (starting with 1), given the delay
+	// returned for the previous attempt (zero for the first attempt). If ok is false, no more
+	// attempts are made.
+	NextDelay(attempt int, previous time.Duration) (delay time.Duration, ok bool)
+}
+
+// Possible values for ExponentialBackoff.Jitter
+const (
+	// JitterNone doubles the delay on each attempt.
+	JitterNone = "none"
+	// JitterFull picks a random delay between zero and the exponentially growing delay.
+	JitterFull = "full"
+	// JitterDecorrelated picks a random delay between InitialDelay and three times the previous delay.
+	JitterDecorrelated = "decorrelated"
+)
+
+// delay before the first retry, if ExponentialBackoff.InitialDelay is not set
+const defaultInitialBackoffDelay = 500 * time.Millisecond
+
+// upper limit of a single delay, if ExponentialBackoff.MaxDelay is not set
+const defaultMaxBackoffDelay = 30 * time.Second
+
+// ExponentialBackoff is a BackoffPolicy with exponentially growing, optionally jittered delays.
+// Jitter spreads retries of many instances in time, so they do not retry in lockstep after an outage.
+type ExponentialBackoff struct {
+	// Delay before the first retry. 0 or a negative value means the default of 500 milliseconds, so that
+	// failing registrations are never retried in a tight loop.
+	InitialDelay time.Duration
+	// Upper limit of a single delay. 0 means the default limit of 30 seconds, so that delays of
+	// failing registrations never grow without bound.
+	MaxDelay time.Duration
+	// One of JitterNone, JitterFull or JitterDecorrelated. Empty or unknown value means JitterNone.
+	Jitter string
+	// Maximum number of consecutive retries, 0 means no limit.
+	MaxAttempts int
+}
+
+// NextDelay implements BackoffPolicy
+func (b ExponentialBackoff) NextDelay(attempt int, previous time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+		return 0, false
+	}
+
+	initialDelay := b.initialDelay()
+	if b.Jitter == JitterDecorrelated {
+		if previous < initialDelay {
+			previous = initialDelay
+		}
+		return b.limit(initialDelay + randomDuration(3*previous-initialDelay)), true
+	}
+
+	delay := initialDelay
+	for i := 1; i < attempt && delay < b.maxDelay(); i++ {
+		delay *= 2
+	}
+	delay = b.limit(delay)
+
+	if b.Jitter == JitterFull {
+		return randomDuration(delay), true
+	}
+	return delay, true
+}
+
+func (b ExponentialBackoff) limit(delay time.Duration) time.Duration {
+	if max := b.maxDelay(); delay > max {
+		return max
+	}
+	return delay
+}
+
+func (b ExponentialBackoff) initialDelay() time.Duration {
+	if b.InitialDelay <= 0 {
+		return defaultInitialBackoffDelay
+	}
+	return b.InitialDelay
+}
+
+func (b ExponentialBackoff) maxDelay() time.Duration {
+	if b.MaxDelay <= 0 {
+		return defaultMaxBackoffDelay
+	}
+	return b.MaxDelay
+}
+
+// returns a random duration in [0, max]
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// loads ExponentialBackoff from kumuluzee.discovery.retry.* configuration keys. Invalid values are logged and
+// replaced with defaults.
+func loadBackoffPolicy(conf config.Util, logger *logm.Logm) BackoffPolicy {
+	policy := ExponentialBackoff{
+		InitialDelay: defaultInitialBackoffDelay,
+		MaxDelay:     defaultMaxBackoffDelay,
+		Jitter:       JitterFull,
+	}
+
+	if id, ok := conf.GetInt("kumuluzee.discovery.retry.initial-delay-ms"); ok {
+		if id > 0 {
+			policy.InitialDelay = time.Duration(id) * time.Millisecond
+		} else {
+			logger.Warning("Invalid kumuluzee.discovery.retry.initial-delay-ms %d, using default of %d ms",
+				id, defaultInitialBackoffDelay/time.Millisecond)
+		}
+	}
+	if md, ok := conf.GetInt("kumuluzee.discovery.retry.max-delay-ms"); ok {
+		if md >= 0 {
+			policy.MaxDelay = time.Duration(md) * time.Millisecond
+		} else {
+			logger.Warning("Invalid kumuluzee.discovery.retry.max-delay-ms %d, using default of %d ms",
+				md, defaultMaxBackoffDelay/time.Millisecond)
+		}
+	}
+	if j, ok := conf.GetString("kumuluzee.discovery.retry.jitter"); ok {
+		switch j {
+		case JitterNone, JitterFull, JitterDecorrelated:
+			policy.Jitter = j
+		default:
+			logger.Warning("Invalid kumuluzee.discovery.retry.jitter %s, using default of %s", j, JitterFull)
+		}
+	}
+	if ma, ok := conf.GetInt("kumuluzee.discovery.retry.max-attempts"); ok {
+		if ma >= 0 {
+			policy.MaxAttempts = ma
+		} else {
+			logger.Warning("Invalid kumuluzee.discovery.retry.max-attempts %d, retrying without limit", ma)
+		}
+	}
+
+	return policy
+}
+
+// tracks consecutive failed attempts of a registration run loop
+type retryState struct {
+	policy  BackoffPolicy
+	attempt int
+	delay   time.Duration
+}
+
+// returns delay before the next attempt, or false if attempts are exhausted
+func (r *retryState) next() (time.Duration, bool) {
+	r.attempt++
+	delay, ok := r.policy.NextDelay(r.attempt, r.delay)
+	r.delay = delay
+	return delay, ok
+}
+
+// resets state after a successful attempt
+func (r *retryState) reset() {
+	r.attempt = 0
+	r.delay = 0
+}
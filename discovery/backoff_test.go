@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff ExponentialBackoff
+		want    []time.Duration
+	}{
+		{
+			name:    "doubling up to max delay",
+			backoff: ExponentialBackoff{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+			want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+				800 * time.Millisecond, time.Second, time.Second},
+		},
+		{
+			name:    "default initial delay",
+			backoff: ExponentialBackoff{InitialDelay: 0, MaxDelay: time.Second},
+			want:    []time.Duration{500 * time.Millisecond, time.Second, time.Second},
+		},
+		{
+			name:    "negative initial delay",
+			backoff: ExponentialBackoff{InitialDelay: -time.Second, MaxDelay: time.Second},
+			want:    []time.Duration{500 * time.Millisecond, time.Second},
+		},
+		{
+			name:    "default max delay",
+			backoff: ExponentialBackoff{InitialDelay: 10 * time.Second},
+			want:    []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		var delay time.Duration
+		for i, want := range test.want {
+			var ok bool
+			if delay, ok = test.backoff.NextDelay(i+1, delay); !ok || delay != want {
+				t.Errorf("%s: attempt %d: delay = %s, %v, want %s, true", test.name, i+1, delay, ok, want)
+			}
+		}
+	}
+}
+
+func TestExponentialBackoffJitterLimits(t *testing.T) {
+	for _, backoff := range []ExponentialBackoff{
+		{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: JitterFull},
+		{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: JitterDecorrelated},
+		{InitialDelay: time.Second, Jitter: JitterDecorrelated},
+		{Jitter: JitterDecorrelated},
+	} {
+		min := time.Duration(0)
+		if backoff.Jitter == JitterDecorrelated {
+			min = backoff.initialDelay()
+		}
+
+		var delay time.Duration
+		for attempt := 1; attempt <= 100; attempt++ {
+			delay, _ = backoff.NextDelay(attempt, delay)
+			if delay < min || delay > backoff.maxDelay() {
+				t.Fatalf("%s jitter: attempt %d: delay %s is not in [%s, %s]",
+					backoff.Jitter, attempt, delay, min, backoff.maxDelay())
+			}
+		}
+	}
+}
+
+func TestExponentialBackoffMaxAttempts(t *testing.T) {
+	backoff := ExponentialBackoff{InitialDelay: time.Millisecond, MaxAttempts: 2}
+	for attempt, wantOk := range []bool{true, true, false} {
+		if _, ok := backoff.NextDelay(attempt+1, 0); ok != wantOk {
+			t.Errorf("attempt %d: ok = %v, want %v", attempt+1, ok, wantOk)
+		}
+	}
+}
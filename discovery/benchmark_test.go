@@ -0,0 +1,92 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+// returns instances of 10 versions with 10 instances each
+func benchmarkInstances() []discoveredService {
+	var instances []discoveredService
+	for minor := 0; minor < 10; minor++ {
+		for i := 0; i < 10; i++ {
+			instances = append(instances, discoveredService{
+				id:        fmt.Sprintf("instance-%d-%d", minor, i),
+				version:   semver.Version{Major: 1, Minor: uint64(minor)},
+				directURL: fmt.Sprintf("http://10.0.%d.%d:8080", minor, i),
+			})
+		}
+	}
+	return instances
+}
+
+// ranges are cached, so this measures the cache lookup done on every discovery
+func BenchmarkParseVersion(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseVersion(">=1.2.0 <2.0.0 || ^3.1.x"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// instance versions are cached, so this measures the cache lookup done for every discovered instance
+func BenchmarkParseInstanceVersion(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseInstanceVersion("1.4.2"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSelectServiceInstances(b *testing.B) {
+	instances := benchmarkInstances()
+	options := DiscoverOptions{Value: "orders", Version: "^1.2.0"}
+	fillDefaultDiscoverOptions(&options)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := selectServiceInstances(instances, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPickRandomServiceInstance(b *testing.B) {
+	instances := benchmarkInstances()
+	options := DiscoverOptions{Value: "orders", Version: "^1.2.0"}
+	fillDefaultDiscoverOptions(&options)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pickRandomServiceInstance(instances, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// interval in which bound fields are checked for changes in service membership and gateway URLs
+const bindRefreshInterval = 10 * time.Second
+
+// a struct field bound to a discovered service
+type boundField struct {
+	field   reflect.Value
+	options DiscoverOptions
+}
+
+// Bind fills string fields of struct, pointed to by target, with URLs of discovered services and keeps them
+// updated as service membership or gateway URLs change, until ctx is done. Fields are bound with the discover
+// tag, holding the name of the service, optionally followed by version, access and environment (comma
+// separated). Target must implement sync.Locker, usually by embedding sync.RWMutex, since fields are updated
+// from a background goroutine while the target is locked:
+//
+//	type Dependencies struct {
+//		sync.RWMutex
+//		Orders string `discover:"orders,version=^1.0,access=direct"`
+//	}
+//
+// Readers must hold the lock while reading bound fields, e.g. with deps.RLock(). Options, that are not set in
+// the tag, are filled from configuration like in DiscoverService. A field keeps its URL while the instance is
+// still discovered, so that consumers are not moved between instances on every update. If discovery fails,
+// the previous URL is kept.
+func (d Util) Bind(ctx context.Context, target sync.Locker) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Bind target must be a non-nil pointer to struct, got %T", target)
+	}
+
+	var fields []boundField
+	t := v.Elem().Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("discover")
+		if !ok {
+			continue
+		}
+
+		field := v.Elem().Field(i)
+		if field.Kind() != reflect.String || !field.CanSet() {
+			return fmt.Errorf("Field %s with discover tag must be an exported string field", t.Field(i).Name)
+		}
+
+		options, err := parseDiscoverTag(tag)
+		if err != nil {
+			return fmt.Errorf("Invalid discover tag of field %s: %s", t.Field(i).Name, err.Error())
+		}
+
+		fields = append(fields, boundField{field: field, options: options})
+	}
+
+	d.updateBoundFields(fields, target)
+	go func() {
+		ticker := time.NewTicker(bindRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.updateBoundFields(fields, target)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// discovers services of bound fields and sets fields, whose URL is not discovered anymore, while locker is held
+func (d Util) updateBoundFields(fields []boundField, locker sync.Locker) {
+	for _, f := range fields {
+		urls, err := d.discoverURLs(f.options)
+		if err != nil {
+			d.Logger.Warning("Discovery of bound service %s failed, keeping previous URL. Error: %s", f.options.Value, err.Error())
+			continue
+		}
+
+		locker.Lock()
+		current := f.field.String()
+		if !containsString(urls, current) {
+			newURL := urls[rand.Intn(len(urls))]
+			d.Logger.Info("Updated bound URL of service %s (new value: %s)", f.options.Value, newURL)
+			f.field.SetString(newURL)
+		}
+		locker.Unlock()
+	}
+}
+
+// converts discover tag, e.g. "orders,version=^1.0,access=direct", to DiscoverOptions
+func parseDiscoverTag(tag string) (DiscoverOptions, error) {
+	var options DiscoverOptions
+
+	parts := strings.Split(tag, ",")
+	options.Value = strings.TrimSpace(parts[0])
+	if options.Value == "" {
+		return options, fmt.Errorf("missing service name")
+	}
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return options, fmt.Errorf("expected key=value, got %q", part)
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "version":
+			options.Version = value
+		case "access":
+			switch value = strings.ToLower(value); value {
+			case AccessTypeDirect, AccessTypeGateway, AccessTypeConnect:
+				options.AccessType = value
+			default:
+				return options, fmt.Errorf("invalid access type %q", value)
+			}
+		case "environment", "env":
+			options.Environment = value
+		default:
+			return options, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	return options, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestParseDiscoverTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want DiscoverOptions
+	}{
+		{"orders", DiscoverOptions{Value: "orders"}},
+		{" orders , version=^1.0 ", DiscoverOptions{Value: "orders", Version: "^1.0"}},
+		{"orders,access=GATEWAY", DiscoverOptions{Value: "orders", AccessType: AccessTypeGateway}},
+		{"orders,access=connect,environment=prod", DiscoverOptions{Value: "orders", AccessType: AccessTypeConnect, Environment: "prod"}},
+		{"orders,env=dev,version=1.2.x,access=direct", DiscoverOptions{Value: "orders", Version: "1.2.x", AccessType: AccessTypeDirect, Environment: "dev"}},
+	}
+
+	for _, test := range tests {
+		options, err := parseDiscoverTag(test.tag)
+		if err != nil {
+			t.Errorf("parseDiscoverTag(%q) failed: %s", test.tag, err.Error())
+			continue
+		}
+		if options.Value != test.want.Value || options.Version != test.want.Version ||
+			options.AccessType != test.want.AccessType || options.Environment != test.want.Environment {
+			t.Errorf("parseDiscoverTag(%q) = %+v, want %+v", test.tag, options, test.want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		",version=^1.0",
+		"orders,version",
+		"orders,weight=10",
+		"orders,access=proxy",
+	}
+
+	for _, tag := range invalid {
+		if options, err := parseDiscoverTag(tag); err == nil {
+			t.Errorf("parseDiscoverTag(%q) = %+v, want error", tag, options)
+		}
+	}
+}
+
+// implements sync.Locker with value receiver, so that it can be passed to Bind by value
+type valueLocker struct {
+	Orders string `discover:"orders"`
+}
+
+func (valueLocker) Lock()   {}
+func (valueLocker) Unlock() {}
+
+// implements sync.Locker, but is not a struct
+type stringLocker string
+
+func (stringLocker) Lock()   {}
+func (stringLocker) Unlock() {}
+
+type unexportedFieldTarget struct {
+	sync.Mutex
+	orders string `discover:"orders"`
+}
+
+type nonStringFieldTarget struct {
+	sync.Mutex
+	Orders int `discover:"orders"`
+}
+
+type unknownKeyTarget struct {
+	sync.Mutex
+	Orders string `discover:"orders,weight=10"`
+}
+
+type badAccessTarget struct {
+	sync.Mutex
+	Orders string `discover:"orders,access=proxy"`
+}
+
+func TestBindInvalidTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		target sync.Locker
+	}{
+		{"non-pointer target", valueLocker{}},
+		{"nil target", (*valueLocker)(nil)},
+		{"pointer to non-struct", new(stringLocker)},
+		{"unexported field", &unexportedFieldTarget{}},
+		{"non-string field", &nonStringFieldTarget{}},
+		{"unknown tag key", &unknownKeyTarget{}},
+		{"bad access type", &badAccessTarget{}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, test := range tests {
+		if err := (Util{}).Bind(ctx, test.target); err == nil {
+			t.Errorf("%s: Bind succeeded, want error", test.name)
+		}
+	}
+}
@@ -22,9 +22,12 @@
 package discovery
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mc0239/logm"
 
@@ -52,34 +55,386 @@ type registerConfiguration struct {
 	}
 }
 
+// returned when no instance with matching version was discovered
+var errNoMatchingService = errors.New("No service found (no matching version)")
+
+var errNoVersionWeights = errors.New("No version weights set for weighted version selection")
+
 type discoveredService struct {
-	version   semver.Version
-	id        string
-	directURL string
+	version    semver.Version
+	id         string
+	directURL  string
+	gatewayURL string
+	datacenter string // set only by discovery sources with datacenters
 	// TODO: containerURL ?
 }
 
-type gatewayURLWatch struct {
-	gatewayID  string
-	gatewayURL string
+// holds values of configuration keys in namespaces of discovered services, which are kept up to date with
+// watches. Values are stored parsed. Safe for concurrent use.
+type watchedKeys struct {
+	mutex  sync.RWMutex
+	values map[string]interface{} // parsed values by watcher namespace
 }
 
-//
+// returns current parsed value of key in given namespace and creates a watch for it, if not already made
+func (w *watchedKeys) get(configOptions config.Options, watcherNamespace string, key string,
+	parse func(value string) interface{}, logger *logm.Logm) interface{} {
 
-func getRetryDelays(conf config.Util) (startRD, maxRD int64) {
-	if sdl, ok := conf.GetInt("kumuluzee.config.start-retry-delay-ms"); ok {
-		startRD = int64(sdl)
-	} else {
-		startRD = 500
+	w.mutex.RLock()
+	value, ok := w.values[watcherNamespace]
+	w.mutex.RUnlock()
+	if ok {
+		// watch already set :)
+		return value
 	}
 
-	if mdl, ok := conf.GetInt("kumuluzee.config.max-retry-delay-ms"); ok {
-		maxRD = int64(mdl)
-	} else {
-		maxRD = 900000
+	// make a watch for this one! Value is read outside of the lock, so that discovery of other services
+	// is not blocked while the registry is queried.
+	util := config.NewUtil(config.Options{
+		Extension:          configOptions.Extension,
+		ExtensionNamespace: watcherNamespace,
+		ConfigPath:         configOptions.ConfigPath,
+		LogLevel:           logm.LvlMute,
+	})
+	rawValue, _ := util.GetString(key)
+	value = parse(rawValue)
+
+	w.mutex.Lock()
+	if current, ok := w.values[watcherNamespace]; ok {
+		// watch was set in the meantime
+		w.mutex.Unlock()
+		return current
+	}
+	if w.values == nil {
+		w.values = make(map[string]interface{})
 	}
+	w.values[watcherNamespace] = value
+	w.mutex.Unlock()
 
-	return
+	logger.Info("Creating a %s watch for %s", key, watcherNamespace)
+	util.Subscribe(key, func(key string, rawValue string) {
+		logger.Info("Updated %s value for %s (new value: %s)", key, watcherNamespace, rawValue)
+		value := parse(rawValue)
+		w.mutex.Lock()
+		w.values[watcherNamespace] = value
+		w.mutex.Unlock()
+	})
+
+	return value
+}
+
+// holds gatewayUrl values of discovered service versions. Safe for concurrent use.
+type gatewayURLWatches struct {
+	watches watchedKeys
+}
+
+// returns current gatewayUrl value of given service version and creates a watch for it, if not already made
+func (g *gatewayURLWatches) get(configOptions config.Options, options DiscoverOptions, version semver.Version, logger *logm.Logm) string {
+	watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, version.String())
+
+	return g.watches.get(configOptions, watcherNamespace, "gatewayUrl", func(value string) interface{} {
+		return normalizeGatewayURL(value, watcherNamespace, logger)
+	}, logger).(string)
+}
+
+// returns normalized gatewayUrl value. Invalid values are logged and used as they are.
+func normalizeGatewayURL(gatewayURL string, watcherNamespace string, logger *logm.Logm) string {
+	if gatewayURL == "" {
+		return ""
+	}
+	normalized, err := normalizeServiceURL(gatewayURL)
+	if err != nil {
+		logger.Warning("Invalid gatewayUrl value for %s: %s", watcherNamespace, err.Error())
+		return gatewayURL
+	}
+	return normalized
+}
+
+// identifies a discovery query in lastKnownServices
+type lastKnownServiceKey struct {
+	environment string
+	name        string
+	version     string
+	accessType  string
+}
+
+type lastKnownService struct {
+	result     DiscoveryResult
+	discovered time.Time
+}
+
+// holds last successfully discovered service for each discovery query, used when discovery fails.
+// Safe for concurrent use.
+type lastKnownServices struct {
+	mutex    sync.RWMutex
+	services map[lastKnownServiceKey]lastKnownService
+	maxAge   time.Duration // services older than maxAge are not used, 0 means no limit
+	modified time.Time     // time of the last change, used when persisting snapshots
+}
+
+func newLastKnownServiceKey(options DiscoverOptions) lastKnownServiceKey {
+	return lastKnownServiceKey{
+		environment: options.Environment,
+		name:        options.Value,
+		version:     options.Version,
+		accessType:  options.AccessType,
+	}
+}
+
+// returns last known service for given query, if there is one and it is not older than maxAge
+func (l *lastKnownServices) get(options DiscoverOptions) (DiscoveryResult, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	service, ok := l.services[newLastKnownServiceKey(options)]
+	if !ok {
+		return DiscoveryResult{}, false
+	}
+	if l.maxAge > 0 && time.Since(service.discovered) > l.maxAge {
+		return DiscoveryResult{}, false
+	}
+	return service.result, true
+}
+
+func (l *lastKnownServices) set(options DiscoverOptions, result DiscoveryResult) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.services == nil {
+		l.services = make(map[lastKnownServiceKey]lastKnownService)
+	}
+	l.modified = time.Now()
+	l.services[newLastKnownServiceKey(options)] = lastKnownService{
+		result:     result,
+		discovered: l.modified,
+	}
+}
+
+func (l *lastKnownServices) lastModified() time.Time {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.modified
+}
+
+// returns all last known services in a form suitable for persisting
+func (l *lastKnownServices) snapshot() []snapshotService {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	services := make([]snapshotService, 0, len(l.services))
+	for key, service := range l.services {
+		services = append(services, snapshotService{
+			Environment:           key.environment,
+			Name:                  key.name,
+			Version:               key.version,
+			AccessType:            key.accessType,
+			URL:                   service.result.URL,
+			DiscoveredEnvironment: service.result.Environment,
+			Datacenter:            service.result.Datacenter,
+			Discovered:            service.discovered,
+		})
+	}
+	return services
+}
+
+// adds persisted services to last known services. Services that were discovered later are kept.
+func (l *lastKnownServices) restore(services []snapshotService) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.services == nil {
+		l.services = make(map[lastKnownServiceKey]lastKnownService)
+	}
+	for _, s := range services {
+		key := lastKnownServiceKey{
+			environment: s.Environment,
+			name:        s.Name,
+			version:     s.Version,
+			accessType:  s.AccessType,
+		}
+		if existing, ok := l.services[key]; ok && existing.discovered.After(s.Discovered) {
+			continue
+		}
+		discoveredEnvironment := s.DiscoveredEnvironment
+		if discoveredEnvironment == "" {
+			// snapshot was persisted before environment fallback was supported
+			discoveredEnvironment = s.Environment
+		}
+		l.services[key] = lastKnownService{
+			result: DiscoveryResult{
+				URL:         s.URL,
+				Environment: discoveredEnvironment,
+				Datacenter:  s.Datacenter,
+			},
+			discovered: s.Discovered,
+		}
+	}
+}
+
+// discovers a random instance of service with given options, using discoverInstances of a discovery source
+// and applying current routing rules of the service. Environments are tried in order of discoverEnvironments,
+// until an instance with matching version is found. If discovery fails, last known service for the same
+// options is returned (if there is one), with DiscoveryResult.Stale set to true.
+func discoverService(discoverInstances func(options DiscoverOptions) ([]discoveredService, error),
+	getRoutingRules func(options DiscoverOptions) *routingRules,
+	lastKnown *lastKnownServices, options DiscoverOptions, logger *logm.Logm) (DiscoveryResult, error) {
+
+	fillDefaultDiscoverOptions(&options)
+
+	var result DiscoveryResult
+	var err error
+	for _, environment := range discoverEnvironments(options) {
+		envOptions := options
+		envOptions.Environment = environment
+
+		var discoveredInstances []discoveredService
+		discoveredInstances, err = discoverInstances(envOptions)
+		if err != nil {
+			break // registry error, don't fall back to other environments
+		}
+
+		routedOptions := getRoutingRules(envOptions).apply(discoveredInstances, envOptions)
+		result, err = pickRandomServiceInstance(discoveredInstances, routedOptions)
+		if err != errNoMatchingService {
+			result.Environment = environment
+			break
+		}
+		logger.Verbose("No instances of service %s found in environment %s", options.Value, environment)
+	}
+
+	if err != nil {
+		if lastKnownService, ok := lastKnown.get(options); ok {
+			logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
+			lastKnownService.Stale = true
+			return lastKnownService, nil
+		}
+
+		logger.Error("Service discovery failed: %s", err.Error())
+		return DiscoveryResult{}, err
+	}
+
+	lastKnown.set(options, result)
+	return result, nil
+}
+
+// returns environments to discover services in, in order of preference: options.Environment,
+// followed by options.FallbackEnvironments
+func discoverEnvironments(options DiscoverOptions) []string {
+	environments := []string{options.Environment}
+	for _, env := range options.FallbackEnvironments {
+		if env != "" && env != options.Environment {
+			environments = append(environments, env)
+		}
+	}
+	return environments
+}
+
+func getLastKnownServiceMaxAge(conf config.Util) time.Duration {
+	if ma, ok := conf.GetInt("kumuluzee.discovery.last-known-service.max-age-ms"); ok {
+		return time.Duration(ma) * time.Millisecond
+	}
+	return 0
+}
+
+// default values of DiscoverOptions, loaded from configuration when Util is created. Options, that are not set
+// by the caller, are filled with per-service defaults (kumuluzee.discovery.services.<name>.*) and then with
+// global defaults. Safe for concurrent use.
+type discoverDefaults struct {
+	conf config.Util
+
+	environment string
+	version     string
+	accessType  string
+
+	mutex    sync.RWMutex
+	services map[string]serviceDiscoverDefaults // per-service defaults by service name, loaded on first use
+}
+
+type serviceDiscoverDefaults struct {
+	version       string
+	accessType    string
+	preparedQuery string
+}
+
+func loadDiscoverDefaults(confOptions config.Options, logger *logm.Logm) *discoverDefaults {
+	d := discoverDefaults{
+		conf: config.NewUtil(config.Options{
+			ConfigPath: confOptions.ConfigPath,
+			LogLevel:   logm.LvlWarning, // bit less logs from config
+		}),
+	}
+
+	d.environment, _ = d.conf.GetString("kumuluzee.env.name")
+	d.version, _ = d.conf.GetString("kumuluzee.discovery.default-version")
+	d.accessType = d.loadAccessType("kumuluzee.discovery.default-access-type", logger)
+
+	return &d
+}
+
+func (d *discoverDefaults) fill(options *DiscoverOptions, logger *logm.Logm) {
+	if d == nil {
+		return
+	}
+
+	service := d.service(options.Value, logger)
+
+	if options.Environment == "" {
+		options.Environment = d.environment
+	}
+	if options.Version == "" {
+		options.Version = service.version
+	}
+	if options.Version == "" {
+		options.Version = d.version
+	}
+	if options.AccessType == "" {
+		options.AccessType = service.accessType
+	}
+	if options.AccessType == "" {
+		options.AccessType = d.accessType
+	}
+	if options.PreparedQuery == "" {
+		options.PreparedQuery = service.preparedQuery
+	}
+}
+
+// returns per-service defaults of given service
+func (d *discoverDefaults) service(name string, logger *logm.Logm) serviceDiscoverDefaults {
+	d.mutex.RLock()
+	service, ok := d.services[name]
+	d.mutex.RUnlock()
+	if ok {
+		return service
+	}
+
+	prefix := "kumuluzee.discovery.services." + name
+	service.version, _ = d.conf.GetString(prefix + ".version")
+	service.accessType = d.loadAccessType(prefix+".access-type", logger)
+	service.preparedQuery, _ = d.conf.GetString(prefix + ".prepared-query")
+
+	d.mutex.Lock()
+	if d.services == nil {
+		d.services = make(map[string]serviceDiscoverDefaults)
+	}
+	d.services[name] = service
+	d.mutex.Unlock()
+
+	return service
+}
+
+func (d *discoverDefaults) loadAccessType(key string, logger *logm.Logm) string {
+	accessType, ok := d.conf.GetString(key)
+	if !ok {
+		return ""
+	}
+
+	switch accessType = strings.ToLower(accessType); accessType {
+	case AccessTypeDirect, AccessTypeGateway, AccessTypeConnect:
+		return accessType
+	default:
+		logger.Warning("Ignoring invalid access type %s in configuration key %s", accessType, key)
+		return ""
+	}
 }
 
 func fillDefaultDiscoverOptions(options *DiscoverOptions) {
@@ -93,6 +448,9 @@ func fillDefaultDiscoverOptions(options *DiscoverOptions) {
 	if options.AccessType == "" {
 		options.AccessType = AccessTypeGateway
 	}
+	if options.VersionSelection == "" {
+		options.VersionSelection = VersionSelectionLatest
+	}
 }
 
 func loadServiceRegisterConfiguration(confOptions config.Options, regOptions RegisterOptions) (regconf registerConfiguration) {
@@ -130,28 +488,29 @@ func loadServiceRegisterConfiguration(confOptions config.Options, regOptions Reg
 	return
 }
 
-func parseVersion(version string) (semver.Range, error) {
-	version = strings.Replace(version, "*", "x", -1)
-
-	if strings.HasPrefix(version, "^") {
-		ver, err := semver.ParseTolerant(version[1:])
-		if err == nil {
-			var verNext = ver
-			verNext.Major++
-			return semver.ParseRange(">=" + ver.String() + " <" + verNext.String())
+// validates base URL and address of service and normalizes them, see normalizeServiceURL
+func validateServiceRegisterConfiguration(regconf *registerConfiguration) error {
+	if regconf.Server.BaseURL != "" {
+		baseURL, err := normalizeServiceURL(regconf.Server.BaseURL)
+		if err != nil {
+			return fmt.Errorf("Invalid base-url: %s", err.Error())
 		}
-		return nil, err
-	} else if strings.HasPrefix(version, "~") {
-		ver, err := semver.ParseTolerant(version[1:])
-		if err == nil {
-			var verNext = ver
-			verNext.Minor++
-			return semver.ParseRange(">=" + ver.String() + " <" + verNext.String())
+		regconf.Server.BaseURL = baseURL
+	}
+
+	if regconf.Server.HTTP.Address != "" {
+		address, err := normalizeServiceHost(regconf.Server.HTTP.Address)
+		if err != nil {
+			return fmt.Errorf("Invalid server address: %s", err.Error())
 		}
-		return nil, err
-	} else {
-		return semver.ParseRange(version)
+		regconf.Server.HTTP.Address = address
 	}
+
+	if regconf.Server.HTTP.Port < 1 || regconf.Server.HTTP.Port > 65535 {
+		return fmt.Errorf("Invalid server port: %d", regconf.Server.HTTP.Port)
+	}
+
+	return nil
 }
 
 func extractServicesWithVersion(services []discoveredService, wantVersion semver.Range) []discoveredService {
@@ -160,15 +519,20 @@ func extractServicesWithVersion(services []discoveredService, wantVersion semver
 	// then, return services that match only the latest version
 
 	var latestVersion semver.Version
+	var found bool
 	for _, s := range services {
 		// if service version is in range of wantVersion
 		if wantVersion(s.version) {
 			// store latest version
-			if s.version.GTE(latestVersion) {
+			if !found || s.version.GTE(latestVersion) {
 				latestVersion = s.version
+				found = true
 			}
 		}
 	}
+	if !found {
+		return nil
+	}
 
 	for _, s := range services {
 		// if service is of latestVersion
@@ -180,45 +544,125 @@ func extractServicesWithVersion(services []discoveredService, wantVersion semver
 	return matchingServices
 }
 
-// returns a randomly picked instace from discovered services.
-// Note that function can return both a valid, non-empty service string and an error, which means
-// that no proper service could be found and the lastKnownService string is being returned
-func pickRandomServiceInstance(discoveredInstances []discoveredService, gatewayUrls []*gatewayURLWatch, options DiscoverOptions, lastKnownService string) (service string, err error) {
+// returns all services with version in range of wantVersion
+func extractServicesInRange(services []discoveredService, wantVersion semver.Range) []discoveredService {
+	var matchingServices []discoveredService
+	for _, s := range services {
+		if wantVersion(s.version) {
+			matchingServices = append(matchingServices, s)
+		}
+	}
+	return matchingServices
+}
+
+// returns services with version in range of any version weight with positive weight
+func extractServicesInWeightedRanges(services []discoveredService, weights []VersionWeight) ([]discoveredService, error) {
+	var weightVersions []semver.Range
+	for _, w := range weights {
+		if w.Weight <= 0 {
+			continue
+		}
+		weightVersion, err := parseVersion(w.Version)
+		if err != nil {
+			return nil, fmt.Errorf("version weight parse error: %s", err.Error())
+		}
+		weightVersions = append(weightVersions, weightVersion)
+	}
+
+	var matchingServices []discoveredService
+	for _, s := range services {
+		for _, weightVersion := range weightVersions {
+			if weightVersion(s.version) {
+				matchingServices = append(matchingServices, s)
+				break
+			}
+		}
+	}
+	return matchingServices, nil
+}
+
+// picks one of the version weights at random, proportionally to their weight, and returns services
+// with version in its range. Weights without any matching services are not considered.
+func extractServicesWithWeightedVersion(services []discoveredService, weights []VersionWeight) ([]discoveredService, error) {
+	var candidates [][]discoveredService
+	var candidateWeights []int
+	totalWeight := 0
+
+	for _, w := range weights {
+		if w.Weight <= 0 {
+			continue
+		}
+		weightVersion, err := parseVersion(w.Version)
+		if err != nil {
+			return nil, fmt.Errorf("version weight parse error: %s", err.Error())
+		}
+		matching := extractServicesInRange(services, weightVersion)
+		if len(matching) == 0 {
+			continue
+		}
+		candidates = append(candidates, matching)
+		candidateWeights = append(candidateWeights, w.Weight)
+		totalWeight += w.Weight
+	}
+
+	if totalWeight == 0 {
+		return nil, nil
+	}
+
+	r := rand.Intn(totalWeight)
+	for i, w := range candidateWeights {
+		if r < w {
+			return candidates[i], nil
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// returns services, from which an instance is picked, according to options.Version and options.VersionSelection
+func selectServiceInstances(discoveredInstances []discoveredService, options DiscoverOptions) ([]discoveredService, error) {
 	wantVersion, err := parseVersion(options.Version)
 	if err != nil {
-		if lastKnownService != "" {
-			return lastKnownService, fmt.Errorf("wantVersion parse error: %s", err.Error())
+		return nil, fmt.Errorf("wantVersion parse error: %s", err.Error())
+	}
+
+	switch options.VersionSelection {
+	case VersionSelectionAll:
+		return extractServicesInRange(discoveredInstances, wantVersion), nil
+	case VersionSelectionWeighted:
+		if len(options.VersionWeights) == 0 {
+			return nil, errNoVersionWeights
 		}
-		return "", fmt.Errorf("wantVersion parse error: %s", err.Error())
+		return extractServicesWithWeightedVersion(extractServicesInRange(discoveredInstances, wantVersion), options.VersionWeights)
+	case VersionSelectionLatest:
+		return extractServicesWithVersion(discoveredInstances, wantVersion), nil
+	default:
+		return nil, fmt.Errorf("Invalid version selection: %s", options.VersionSelection)
 	}
+}
 
+// returns a randomly picked instace from discovered services.
+func pickRandomServiceInstance(discoveredInstances []discoveredService, options DiscoverOptions) (DiscoveryResult, error) {
 	// pick a random service instance from registered instances that match version
-	instances := extractServicesWithVersion(discoveredInstances, wantVersion)
+	instances, err := selectServiceInstances(discoveredInstances, options)
+	if err != nil {
+		return DiscoveryResult{}, err
+	}
 	if len(instances) == 0 {
-		if lastKnownService != "" {
-			return lastKnownService, fmt.Errorf("No service found (no matching version)")
-		}
-		return "", fmt.Errorf("No service found (no matching version)")
+		return DiscoveryResult{}, errNoMatchingService
 	}
 
 	randomInstance := instances[rand.Intn(len(instances))]
-
-	var instanceGatewayURL string
-	watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, randomInstance.version.String())
-	for _, w := range gatewayUrls {
-		if w.gatewayID == watcherNamespace {
-			instanceGatewayURL = w.gatewayURL
-		}
+	result := DiscoveryResult{
+		Datacenter: randomInstance.datacenter,
 	}
 
-	if options.AccessType == AccessTypeGateway && instanceGatewayURL != "" {
-		return instanceGatewayURL, nil
+	if options.AccessType == AccessTypeGateway && randomInstance.gatewayURL != "" {
+		result.URL = randomInstance.gatewayURL
 	} else if randomInstance.directURL != "" {
-		return randomInstance.directURL, nil
+		result.URL = randomInstance.directURL
 	} else {
-		if lastKnownService != "" {
-			return lastKnownService, fmt.Errorf("No service found (no service with URL)")
-		}
-		return "", fmt.Errorf("No service found (no service with URL)")
+		return DiscoveryResult{}, fmt.Errorf("No service found (no service with URL)")
 	}
+	return result, nil
 }
@@ -0,0 +1,241 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+)
+
+// in-process registry, used in place of Consul or etcd. Safe for concurrent use.
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	instances map[string]discoveredService // registered instances by id
+	locks     map[string]string            // lock holders by key
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		instances: make(map[string]discoveredService),
+		locks:     make(map[string]string),
+	}
+}
+
+func (r *fakeRegistry) add(id string, version string, url string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.instances[id] = discoveredService{
+		id:        id,
+		version:   semver.MustParse(version),
+		directURL: url,
+	}
+}
+
+func (r *fakeRegistry) remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.instances, id)
+}
+
+func (r *fakeRegistry) isRegistered(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.instances[id]
+	return ok
+}
+
+func (r *fakeRegistry) discoverInstances(options DiscoverOptions) ([]discoveredService, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var instances []discoveredService
+	for _, instance := range r.instances {
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// returns service instance, which registers itself in the registry
+func (r *fakeRegistry) serviceInstance(id string, version string, singletonLock distributedLock) *serviceInstance {
+	regconf := &registerConfiguration{}
+	regconf.Discovery.PingInterval = 1
+
+	return &serviceInstance{
+		id:      id,
+		options: regconf,
+		register: func() bool {
+			r.add(id, version, "http://"+id+":8080")
+			return true
+		},
+		ttlUpdate: func() (bool, bool) { return true, false },
+		deregister: func() error {
+			r.remove(id)
+			return nil
+		},
+		singletonLock: singletonLock,
+	}
+}
+
+func (r *fakeRegistry) newLock(key string, value string) distributedLock {
+	return &fakeLock{registry: r, key: key, value: value}
+}
+
+type fakeLock struct {
+	registry *fakeRegistry
+	key      string
+	value    string
+}
+
+func (l *fakeLock) tryAcquire() (bool, error) {
+	l.registry.mutex.Lock()
+	defer l.registry.mutex.Unlock()
+
+	if holder, ok := l.registry.locks[l.key]; ok && holder != l.value {
+		return false, nil
+	}
+	l.registry.locks[l.key] = l.value
+	return true, nil
+}
+
+func (l *fakeLock) renew() error {
+	l.registry.mutex.Lock()
+	defer l.registry.mutex.Unlock()
+
+	if l.registry.locks[l.key] != l.value {
+		return errLockLost
+	}
+	return nil
+}
+
+func (l *fakeLock) release() error {
+	l.registry.mutex.Lock()
+	defer l.registry.mutex.Unlock()
+
+	if l.registry.locks[l.key] == l.value {
+		delete(l.registry.locks, l.key)
+	}
+	return nil
+}
+
+func testLogger() *logm.Logm {
+	logger := logm.New("KumuluzEE-discovery-test")
+	logger.LogLevel = logm.LvlMute
+	return &logger
+}
+
+func noRoutingRules(options DiscoverOptions) *routingRules {
+	return nil
+}
+
+// run with go test -race
+func TestConcurrentDiscoveryAndRegistration(t *testing.T) {
+	logger := testLogger()
+	registry := newFakeRegistry()
+	registry.add("static", "1.0.0", "http://10.0.0.1:8080")
+
+	var lastKnown lastKnownServices
+	var gatewayURLs gatewayURLWatches
+	var instances serviceInstances
+	backoff := ExponentialBackoff{InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	var wg sync.WaitGroup
+
+	// discovery
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				options := DiscoverOptions{Value: "orders", Environment: "dev", Version: "^1.0.0"}
+				if _, err := discoverService(registry.discoverInstances, noRoutingRules, &lastKnown, options, logger); err != nil {
+					t.Errorf("discovery failed: %s", err.Error())
+				}
+				lastKnown.snapshot()
+				gatewayURLs.get(config.Options{}, options, semver.MustParse(fmt.Sprintf("1.0.%d", j%3)), logger)
+			}
+		}(i)
+	}
+
+	// registration of singleton and regular instances
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				id := fmt.Sprintf("instance-%d-%d", i, j)
+				var lock distributedLock
+				if j%2 == 0 {
+					lock = registry.newLock("singleton", id)
+				}
+				instances.start(registry.serviceInstance(id, "1.1.0", lock), backoff, logger)
+				instances.ids()
+				instances.reregistrations(id)
+				time.Sleep(time.Millisecond)
+				if err := instances.deregister(id, logger); err != nil {
+					t.Errorf("deregistration failed: %s", err.Error())
+				}
+			}
+		}(i)
+	}
+
+	// renewing and releasing a held lock
+	held, err := acquireLock(context.Background(), registry.newLock("lock", "holder"), 30*time.Millisecond, logger)
+	if err != nil {
+		t.Fatalf("acquiring lock failed: %s", err.Error())
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				held.renew()
+				held.isHeld()
+				time.Sleep(time.Millisecond)
+			}
+			if err := held.release(); err != nil {
+				t.Errorf("releasing lock failed: %s", err.Error())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if held.isHeld() {
+		t.Error("lock is still held after release")
+	}
+	for id := range registry.instances {
+		if strings.HasPrefix(id, "instance-") {
+			t.Errorf("instance %s is still registered after deregistration", id)
+		}
+	}
+	if len(registry.locks) != 0 {
+		t.Errorf("locks are still held after release: %v", registry.locks)
+	}
+}
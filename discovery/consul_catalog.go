@@ -0,0 +1,180 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/kumuluz/kumuluzee-go-config/config"
+)
+
+// Consul registration modes, set with configuration key kumuluzee.discovery.consul.registration-mode
+const (
+	// services are registered with the local agent, which marks them critical if TTL is not updated
+	consulRegistrationAgent = "agent"
+	// services are registered directly in the catalog, for environments without a local agent. Catalog has no
+	// TTL checks, so last heartbeat is stored in service meta and expired services are reaped by other instances.
+	consulRegistrationCatalog = "catalog"
+)
+
+// service meta keys used with catalog registration
+const (
+	consulMetaHeartbeat = "kumuluzee-heartbeat" // unix time of last TTL update
+	consulMetaTTL       = "kumuluzee-ttl"       // TTL in seconds
+)
+
+// time after TTL, after which expired catalog registrations are removed
+const consulCatalogReapAfter = 10 * time.Second
+
+// catalog registration configuration
+type consulCatalogOptions struct {
+	node        string
+	nodeAddress string
+}
+
+func loadConsulCatalogOptions(conf config.Util) consulCatalogOptions {
+	var o consulCatalogOptions
+	o.node, _ = conf.GetString("kumuluzee.discovery.consul.catalog.node")
+	o.nodeAddress, _ = conf.GetString("kumuluzee.discovery.consul.catalog.node-address")
+
+	if o.node == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			o.node = hostname
+		} else {
+			o.node = "kumuluzee"
+		}
+	}
+	return o
+}
+
+// registers service instance in the catalog, with passing check and current time as heartbeat
+func (d *consulDiscoverySource) catalogRegister(inst *consulServiceInstance) bool {
+	d.logger.Info("Registering service in catalog: id=%s node=%s address=%s port=%d",
+		inst.id, d.catalog.node, inst.options.Server.HTTP.Address, inst.options.Server.HTTP.Port)
+
+	if err := d.catalogUpdate(inst); err != nil {
+		d.logger.Error("Service registration failed: %s", err.Error())
+		return false
+	}
+
+	d.logger.Info("Service registered, id=%s", inst.id)
+	return true
+}
+
+// refreshes heartbeat of service instance in the catalog and removes expired instances of the same service
+func (d *consulDiscoverySource) catalogTTLUpdate(inst *consulServiceInstance) (ok bool, expired bool) {
+	if err := d.catalogUpdate(inst); err != nil {
+		d.logger.Error("TTL update failed for service %s, error: %s", inst.id, err.Error())
+		return false, false
+	}
+
+	d.logger.Verbose("TTL update for service %s", inst.id)
+	d.reapExpiredCatalogServices(inst.name)
+	return true, false
+}
+
+func (d *consulDiscoverySource) catalogUpdate(inst *consulServiceInstance) error {
+	nodeAddress := d.catalog.nodeAddress
+	if nodeAddress == "" {
+		nodeAddress = inst.options.Server.HTTP.Address
+	}
+	if nodeAddress == "" {
+		nodeAddress = d.catalog.node
+	}
+
+	meta := d.serviceMeta(inst)
+	meta[consulMetaHeartbeat] = strconv.FormatInt(time.Now().Unix(), 10)
+	meta[consulMetaTTL] = strconv.FormatInt(inst.options.Discovery.TTL, 10)
+
+	_, err := d.client.Catalog().Register(&api.CatalogRegistration{
+		Node:    d.catalog.node,
+		Address: nodeAddress,
+		Service: &api.AgentService{
+			ID:              inst.id,
+			Service:         inst.name,
+			Tags:            []string{d.protocol, inst.versionTag},
+			Address:         inst.options.Server.HTTP.Address,
+			Port:            inst.options.Server.HTTP.Port,
+			Meta:            meta,
+			TaggedAddresses: d.serviceTaggedAddresses(inst),
+		},
+		Check: &api.AgentCheck{
+			Node:      d.catalog.node,
+			CheckID:   "check-" + inst.id,
+			Name:      "TTL check for " + inst.id,
+			Status:    api.HealthPassing,
+			ServiceID: inst.id,
+			Output:    "serviceid=" + inst.id + " time=" + time.Now().Format("2006-01-02 15:04:05"),
+		},
+	}, nil)
+	return err
+}
+
+func (d *consulDiscoverySource) catalogDeregister(inst *consulServiceInstance) error {
+	_, err := d.client.Catalog().Deregister(&api.CatalogDeregistration{
+		Node:      d.catalog.node,
+		ServiceID: inst.id,
+	}, nil)
+	return err
+}
+
+// removes catalog registrations of given service, whose heartbeat is older than their TTL
+func (d *consulDiscoverySource) reapExpiredCatalogServices(name string) {
+	services, _, err := d.client.Catalog().Service(name, "", nil)
+	if err != nil {
+		d.logger.Warning("Listing catalog services for reaping failed: %s", err.Error())
+		return
+	}
+
+	for _, service := range services {
+		if !isConsulCatalogServiceExpired(service.ServiceMeta, consulCatalogReapAfter) {
+			continue
+		}
+
+		d.logger.Info("Removing expired catalog registration of service %s on node %s", service.ServiceID, service.Node)
+		_, err := d.client.Catalog().Deregister(&api.CatalogDeregistration{
+			Node:      service.Node,
+			ServiceID: service.ServiceID,
+		}, nil)
+		if err != nil {
+			d.logger.Warning("Removing expired catalog registration of service %s failed: %s", service.ServiceID, err.Error())
+		}
+	}
+}
+
+// returns true if service, registered in catalog, has not updated its heartbeat for longer than its TTL and
+// grace period. Services without heartbeat meta (e.g. registered with an agent) never expire.
+func isConsulCatalogServiceExpired(meta map[string]string, grace time.Duration) bool {
+	heartbeat, err := strconv.ParseInt(meta[consulMetaHeartbeat], 10, 64)
+	if err != nil {
+		return false
+	}
+	ttl, err := strconv.ParseInt(meta[consulMetaTTL], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(time.Unix(heartbeat, 0)) > time.Duration(ttl)*time.Second+grace
+}
@@ -23,11 +23,12 @@ package discovery
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/blang/semver"
 	"github.com/hashicorp/consul/api"
 	"github.com/kumuluz/kumuluzee-go-config/config"
 	"github.com/mc0239/logm"
@@ -38,32 +39,49 @@ import (
 type consulDiscoverySource struct {
 	client *api.Client
 
-	startRetryDelay int64
-	maxRetryDelay   int64
-	protocol        string
+	backoffPolicy BackoffPolicy
+	protocol      string
+	datacenters   []string // default datacenters to discover services in
 
-	configOptions   config.Options         // passed when calling new...()
-	options         *registerConfiguration // loaded as config bundle
-	serviceInstance *consulServiceInstance
+	taggedAddresses map[string]string // tagged addresses of registered services, by tag
+	addressTags     []string          // tagged addresses preferred when discovering services, in order
 
-	lastKnownService string // last known service from discovery
-	gatewayURLs      []*gatewayURLWatch
+	registrationMode string // consulRegistrationAgent or consulRegistrationCatalog
+	catalog          consulCatalogOptions
+
+	nearestDatacenters nearestDatacenters
+
+	configOptions config.Options // passed when calling new...()
+
+	serviceInstances serviceInstances
+
+	lastKnownServices lastKnownServices // last known services from discovery
+	gatewayURLs       gatewayURLWatches
+	routingRules      routingRulesWatches
 
 	logger *logm.Logm
 }
 
-// holds service instance configuration and state
-type consulServiceInstance struct {
-	isRegistered bool
+// tags of addresses, that can be set with kumuluzee.discovery.consul.tagged-addresses.<tag>
+var consulAddressTags = []string{"lan", "lan_ipv4", "lan_ipv6", "wan", "wan_ipv4", "wan_ipv6"}
+
+// service meta keys, describing how to build URL of the service
+const (
+	consulMetaProtocol = "protocol"
+	consulMetaBasePath = "base-path"
+)
 
+// holds Consul specific service instance configuration
+type consulServiceInstance struct {
 	id         string
 	name       string
 	versionTag string
+	connect    *ConnectOptions // nil if sidecar proxy is not registered
 
-	singleton bool
+	options *registerConfiguration // loaded as config bundle
 }
 
-func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discoverySource {
+func newConsulDiscoverySource(options config.Options, backoffPolicy BackoffPolicy, logger *logm.Logm) discoverySource {
 	var d consulDiscoverySource
 	logger.Verbose("Initializing Consul discovery source")
 	d.logger = logger
@@ -74,10 +92,13 @@ func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discove
 		LogLevel:   logm.LvlWarning, // bit less logs from config
 	})
 
-	startRD, maxRD := getRetryDelays(conf)
-	d.startRetryDelay = startRD
-	d.maxRetryDelay = maxRD
-	logger.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", d.startRetryDelay, d.maxRetryDelay)
+	if backoffPolicy == nil {
+		backoffPolicy = loadBackoffPolicy(conf, logger)
+	}
+	d.backoffPolicy = backoffPolicy
+
+	d.lastKnownServices.maxAge = getLastKnownServiceMaxAge(conf)
+	startDiscoverySnapshots(conf, &d.lastKnownServices, logger)
 
 	var consulAddress string
 	if addr, ok := conf.GetString("kumuluzee.discovery.consul.hosts"); ok {
@@ -98,62 +119,378 @@ func newConsulDiscoverySource(options config.Options, logger *logm.Logm) discove
 		d.protocol = "http"
 	}
 
+	switch mode, _ := conf.GetString("kumuluzee.discovery.consul.registration-mode"); mode {
+	case "", consulRegistrationAgent:
+		d.registrationMode = consulRegistrationAgent
+	case consulRegistrationCatalog:
+		d.registrationMode = consulRegistrationCatalog
+		d.catalog = loadConsulCatalogOptions(conf)
+	default:
+		logger.Warning("Invalid Consul registration mode %s, using agent registration", mode)
+		d.registrationMode = consulRegistrationAgent
+	}
+
+	for _, tag := range consulAddressTags {
+		if addr, ok := conf.GetString("kumuluzee.discovery.consul.tagged-addresses." + tag); ok && addr != "" {
+			if d.taggedAddresses == nil {
+				d.taggedAddresses = make(map[string]string)
+			}
+			d.taggedAddresses[tag] = addr
+		}
+	}
+	if tags, ok := conf.GetString("kumuluzee.discovery.consul.address-tags"); ok && tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			d.addressTags = append(d.addressTags, strings.TrimSpace(tag))
+		}
+	}
+
+	if dcs, ok := conf.GetString("kumuluzee.discovery.consul.datacenters"); ok && dcs != "" {
+		for _, dc := range strings.Split(dcs, ",") {
+			d.datacenters = append(d.datacenters, strings.TrimSpace(dc))
+		}
+	}
+
 	return &d
 }
 
 func (d *consulDiscoverySource) RegisterService(options RegisterOptions) (serviceID string, err error) {
+	uuid4, err := uuid.NewV4()
+	if err != nil {
+		d.logger.Error("Generating service id failed: %s", err.Error())
+		return "", err
+	}
+
+	return d.registerService(options, uuid4.String(), nil)
+}
+
+func (d *consulDiscoverySource) registerService(options RegisterOptions, instanceID string, singletonLock distributedLock) (serviceID string, err error) {
 	regconf := loadServiceRegisterConfiguration(d.configOptions, options)
-	d.options = &regconf
+	if err := validateServiceRegisterConfiguration(&regconf); err != nil {
+		d.logger.Error("Service registration failed: %s", err.Error())
+		return "", err
+	}
+	if err := validateConnectOptions(options.Connect); err != nil {
+		d.logger.Error("Service registration failed: %s", err.Error())
+		return "", err
+	}
 
-	d.serviceInstance = &consulServiceInstance{
-		singleton: options.Singleton,
+	inst := &consulServiceInstance{
+		id:         regconf.Name + "-" + instanceID,
+		name:       regconf.Env.Name + "-" + regconf.Name,
+		versionTag: "version=" + regconf.Version,
+		connect:    options.Connect,
+		options:    &regconf,
 	}
 
-	uuid4, err := uuid.NewV4()
-	if err != nil {
-		d.logger.Error(err.Error())
+	var registration *serviceInstance
+	if d.registrationMode == consulRegistrationCatalog {
+		if inst.connect != nil {
+			d.logger.Warning("Connect sidecar proxy is not registered for service %s, since it requires agent registration", inst.id)
+		}
+		registration = &serviceInstance{
+			id:         inst.id,
+			options:    &regconf,
+			register:   func() bool { return d.catalogRegister(inst) },
+			ttlUpdate:  func() (bool, bool) { return d.catalogTTLUpdate(inst) },
+			deregister: func() error { return d.catalogDeregister(inst) },
+		}
+	} else {
+		registration = &serviceInstance{
+			id:                     inst.id,
+			options:                &regconf,
+			register:               func() bool { return d.register(inst) },
+			ttlUpdate:              func() (bool, bool) { return d.ttlUpdate(inst) },
+			deregister:             func() error { return d.client.Agent().ServiceDeregister(inst.id) },
+			ttlUpdateAfterRegister: true, // registering with Consul does not assume successful TTL update
+		}
+	}
+	registration.singletonLock = singletonLock
+	if singletonLock == nil && options.Singleton {
+		registration.singletonLock = d.newLock(singletonLockKey(&regconf), inst.id,
+			time.Duration(regconf.Discovery.TTL)*time.Second)
+	}
+
+	d.serviceInstances.start(registration, d.backoffPolicy, d.logger)
+
+	return inst.id, nil
+}
+
+func (d *consulDiscoverySource) DeregisterService(serviceID string) error {
+	return d.serviceInstances.deregister(serviceID, d.logger)
+}
+
+func (d *consulDiscoverySource) registeredServiceIDs() []string {
+	return d.serviceInstances.ids()
+}
+
+func (d *consulDiscoverySource) registeredServiceConfiguration(serviceID string) (registerConfiguration, bool) {
+	return d.serviceInstances.configuration(serviceID)
+}
+
+func (d *consulDiscoverySource) reregistrations(serviceID string) int64 {
+	return d.serviceInstances.reregistrations(serviceID)
+}
+
+func (d *consulDiscoverySource) newLock(key string, value string, ttl time.Duration) distributedLock {
+	return &consulLock{
+		client: d.client,
+		key:    strings.TrimPrefix(key, "/"),
+		value:  value,
+		ttl:    ttl,
 	}
+}
 
-	d.serviceInstance.id = d.options.Name + "-" + uuid4.String()
-	d.serviceInstance.name = d.options.Env.Name + "-" + d.options.Name
-	d.serviceInstance.versionTag = "version=" + d.options.Version
+func (d *consulDiscoverySource) putValue(key string, value string) error {
+	_, err := d.client.KV().Put(&api.KVPair{
+		Key:   strings.TrimPrefix(key, "/"),
+		Value: []byte(value),
+	}, nil)
+	return err
+}
 
-	go d.run(d.startRetryDelay)
+func (d *consulDiscoverySource) deleteValue(key string) error {
+	_, err := d.client.KV().Delete(strings.TrimPrefix(key, "/"), nil)
+	return err
+}
 
-	return d.serviceInstance.id, nil
+func (d *consulDiscoverySource) DiscoverService(options DiscoverOptions) (DiscoveryResult, error) {
+	if options.AccessType == AccessTypeConnect {
+		return d.discoverConnectUpstream(options)
+	}
+	return discoverService(d.discoverInstances, d.getRoutingRules, &d.lastKnownServices, options, d.logger)
 }
 
-func (d *consulDiscoverySource) DeregisterService() error {
-	d.logger.Info("Service deregistration, id=%s", d.serviceInstance.id)
-	return d.client.Agent().ServiceDeregister(d.serviceInstance.id)
+func (d *consulDiscoverySource) getRoutingRules(options DiscoverOptions) *routingRules {
+	return d.routingRules.get(d.configOptions, options, d.logger)
 }
 
-func (d *consulDiscoverySource) DiscoverService(options DiscoverOptions) (string, error) {
+// returns URL of the local listener of a Connect sidecar proxy, registered with the local agent, that has the
+// service in options as an upstream
+func (d *consulDiscoverySource) discoverConnectUpstream(options DiscoverOptions) (DiscoveryResult, error) {
 	fillDefaultDiscoverOptions(&options)
+	destinationName := options.Environment + "-" + options.Value
+
+	services, err := d.client.Agent().Services()
+	if err != nil {
+		d.logger.Error("Service discovery failed: %s", err.Error())
+		return DiscoveryResult{}, err
+	}
+
+	for _, service := range services {
+		if service.Kind != api.ServiceKindConnectProxy || service.Proxy == nil {
+			continue
+		}
+		for _, upstream := range service.Proxy.Upstreams {
+			if upstream.DestinationName != destinationName || upstream.LocalBindPort == 0 {
+				continue
+			}
 
+			addr := upstream.LocalBindAddress
+			if addr == "" {
+				addr = "127.0.0.1"
+			}
+			return DiscoveryResult{
+				URL:         "http://" + net.JoinHostPort(addr, strconv.Itoa(upstream.LocalBindPort)),
+				Environment: options.Environment,
+				Datacenter:  upstream.Datacenter,
+			}, nil
+		}
+	}
+
+	err = fmt.Errorf("No service found (no Connect upstream for %s)", destinationName)
+	d.logger.Error("Service discovery failed: %s", err.Error())
+	return DiscoveryResult{}, err
+}
+
+// extracts all services of all versions of given environment and name from the first datacenter in failover
+// order, that has any healthy instances
+func (d *consulDiscoverySource) discoverInstances(options DiscoverOptions) ([]discoveredService, error) {
+	if options.PreparedQuery != "" {
+		// failover is done by the prepared query
+		return d.discoverPreparedQueryInstances(options)
+	}
+
+	datacenters := options.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = d.datacenters
+	}
+	if len(datacenters) == 0 {
+		return d.discoverDatacenterInstances(options, "")
+	}
+
+	wantVersion, err := parseVersion(options.Version)
+	if err != nil {
+		return nil, fmt.Errorf("wantVersion parse error: %s", err.Error())
+	}
+
+	var firstDiscovered []discoveredService // instances of the first datacenter with instances, but none in range
+	tried := make(map[string]bool)
+	for _, dc := range datacenters {
+		candidates := []string{dc}
+		if dc == DatacentersNearest {
+			if candidates, err = d.nearestDatacenters.get(d.client); err != nil {
+				d.logger.Warning("Listing datacenters failed: %s", err.Error())
+				continue
+			}
+		}
+
+		for _, candidate := range candidates {
+			if tried[candidate] {
+				continue
+			}
+			tried[candidate] = true
+
+			var discoveredInstances []discoveredService
+			discoveredInstances, err = d.discoverDatacenterInstances(options, candidate)
+			if err != nil {
+				d.logger.Warning("Service discovery in datacenter %s failed: %s", candidate, err.Error())
+				continue
+			}
+			// fail over also if datacenter has no instances with version in range
+			if len(extractServicesInRange(discoveredInstances, wantVersion)) > 0 {
+				return discoveredInstances, nil
+			}
+			if firstDiscovered == nil && len(discoveredInstances) > 0 {
+				firstDiscovered = discoveredInstances
+			}
+		}
+	}
+
+	if firstDiscovered != nil {
+		// no instances in range in any datacenter, version selection reports no matching version
+		return firstDiscovered, nil
+	}
+	// no healthy instances in any datacenter, return error of the last failed query, if any
+	return nil, err
+}
+
+// extracts all services of all versions of given environment and name in given datacenter. Empty datacenter
+// stands for the datacenter of the local agent.
+func (d *consulDiscoverySource) discoverDatacenterInstances(options DiscoverOptions, datacenter string) ([]discoveredService, error) {
 	queryServiceName := options.Environment + "-" + options.Value
-	serviceEntries, _, err := d.client.Health().Service(queryServiceName, "", true, nil)
+	serviceEntries, _, err := d.client.Health().Service(queryServiceName, "", true, &api.QueryOptions{
+		Datacenter: datacenter,
+	})
 	if err != nil {
-		if d.lastKnownService != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
+		return nil, err
+	}
+
+	return d.serviceEntryInstances(serviceEntries, options, datacenter), nil
+}
+
+// extracts all services of all versions by executing prepared query options.PreparedQuery. If the query does not
+// exist, it is created from options.
+func (d *consulDiscoverySource) discoverPreparedQueryInstances(options DiscoverOptions) ([]discoveredService, error) {
+	resp, _, err := d.client.PreparedQuery().Execute(options.PreparedQuery, nil)
+	if err != nil && isConsulQueryNotFound(err) {
+		d.logger.Info("Creating prepared query %s", options.PreparedQuery)
+		if _, _, cErr := d.client.PreparedQuery().Create(d.preparedQueryDefinition(options), nil); cErr != nil {
+			return nil, cErr
 		}
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
+		resp, _, err = d.client.PreparedQuery().Execute(options.PreparedQuery, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// prepared query is not bound to options.Environment, only keep instances of the service in this environment,
+	// so that environment fallback and gateway URLs use the environment the instances are registered in
+	name := options.Environment + "-" + options.Value
+	var serviceEntries []*api.ServiceEntry
+	for i := range resp.Nodes {
+		if resp.Nodes[i].Service == nil || resp.Nodes[i].Service.Service != name {
+			continue
+		}
+		serviceEntries = append(serviceEntries, &resp.Nodes[i])
+	}
+	if len(serviceEntries) < len(resp.Nodes) {
+		d.logger.Verbose("Prepared query %s returned instances of services other than %s, ignoring them",
+			options.PreparedQuery, name)
+	}
+	return d.serviceEntryInstances(serviceEntries, options, resp.Datacenter), nil
+}
+
+// returns prepared query definition, which queries healthy instances of service in options, sorted by round trip
+// time from the querying agent and failing over to options.Datacenters
+func (d *consulDiscoverySource) preparedQueryDefinition(options DiscoverOptions) *api.PreparedQueryDefinition {
+	datacenters := options.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = d.datacenters
+	}
+
+	var failover api.QueryDatacenterOptions
+	for _, dc := range datacenters {
+		if dc == DatacentersNearest {
+			if all, err := d.nearestDatacenters.get(d.client); err == nil {
+				failover.NearestN = len(all)
+			}
+		} else if dc != "" {
+			failover.Datacenters = append(failover.Datacenters, dc)
+		}
+	}
+
+	return &api.PreparedQueryDefinition{
+		Name: options.PreparedQuery,
+		Service: api.ServiceQuery{
+			Service:     options.Environment + "-" + options.Value,
+			Near:        "_agent",
+			OnlyPassing: true,
+			Failover:    failover,
+		},
+	}
+}
+
+// returns address and port of service entry. The first tagged address in options.AddressTags (or configured
+// address tags), that is set, is used. Otherwise service address is used, or node address, if service address
+// is not set.
+func (d *consulDiscoverySource) serviceEntryAddress(serviceEntry *api.ServiceEntry, options DiscoverOptions) (string, int) {
+	addressTags := options.AddressTags
+	if len(addressTags) == 0 {
+		addressTags = d.addressTags
 	}
 
-	// ----- extract all services of all versions of given environment and name
+	for _, tag := range addressTags {
+		if a, ok := serviceEntry.Service.TaggedAddresses[tag]; ok && a.Address != "" {
+			if a.Port != 0 {
+				return a.Address, a.Port
+			}
+			return a.Address, serviceEntry.Service.Port
+		}
+		// node tagged addresses apply only to services using node address
+		if a := serviceEntry.Node.TaggedAddresses[tag]; a != "" && serviceEntry.Service.Address == "" {
+			return a, serviceEntry.Service.Port
+		}
+	}
+
+	if a := serviceEntry.Service.Address; a != "" {
+		return a, serviceEntry.Service.Port
+	}
+	// if address is not set, it's equal to node's address
+	return serviceEntry.Node.Address, serviceEntry.Service.Port
+}
+
+// converts Consul service entries to discovered services
+func (d *consulDiscoverySource) serviceEntryInstances(serviceEntries []*api.ServiceEntry, options DiscoverOptions, datacenter string) []discoveredService {
 	var discoveredInstances []discoveredService
 	for _, serviceEntry := range serviceEntries {
+		if isConsulCatalogServiceExpired(serviceEntry.Service.Meta, 0) {
+			continue // registered in catalog and not reaped yet
+		}
+
 		discoveredInstance := discoveredService{}
-		discoveredInstance.id = serviceEntry.Service.ID
+		// without service name prefix, so that the id is the same as in other registries
+		discoveredInstance.id = strings.TrimPrefix(serviceEntry.Service.ID, options.Value+"-")
+		discoveredInstance.datacenter = serviceEntry.Node.Datacenter
+		if discoveredInstance.datacenter == "" {
+			discoveredInstance.datacenter = datacenter
+		}
 
 		versionOk := false
 		protocol := "http"
 		for _, tag := range serviceEntry.Service.Tags {
 			if strings.HasPrefix(tag, "version") {
 				t := strings.Split(tag, "=")
-				version, err := semver.ParseTolerant(t[1])
+				version, err := parseInstanceVersion(t[1])
 				if err != nil {
 					d.logger.Warning("semver parsing failed for: %s, error: %s", t[1], err.Error())
 					versionOk = false
@@ -168,154 +505,58 @@ func (d *consulDiscoverySource) DiscoverService(options DiscoverOptions) (string
 		if !versionOk {
 			continue // ignore this service, can't parse version
 		}
-
-		var addr string
-		if a := serviceEntry.Service.Address; a != "" {
-			addr = a
-		} else {
-			// if address is not set, it's equal to node's address
-			addr = serviceEntry.Node.Address
+		if p := serviceEntry.Service.Meta[consulMetaProtocol]; p != "" {
+			protocol = p
 		}
 
-		discoveredInstance.directURL = fmt.Sprintf("%s://%s:%d",
-			protocol,
-			addr,
-			serviceEntry.Service.Port)
-
-		discoveredInstances = append(discoveredInstances, discoveredInstance)
-
-		// ---- add a watch for gatewayUrl for discovering service (if not already made)
-		watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, discoveredInstance.version.String())
-
-		util := config.NewUtil(config.Options{
-			Extension:          d.configOptions.Extension,
-			ExtensionNamespace: watcherNamespace,
-			ConfigPath:         d.configOptions.ConfigPath,
-			LogLevel:           logm.LvlMute,
-		})
+		addr, port := d.serviceEntryAddress(serviceEntry, options)
+		discoveredInstance.directURL = buildServiceURL(protocol, addr, port, serviceEntry.Service.Meta[consulMetaBasePath])
 
-		var hasWatch bool
-		for _, w := range d.gatewayURLs {
-			if w.gatewayID == watcherNamespace {
-				// watch already set :)
-				hasWatch = true
-				break
-			}
-		}
-		if !hasWatch {
-			// make a watch for this one!
-			d.logger.Info("Creating a gatewayUrl watch for %s", watcherNamespace)
-
-			g, _ := util.GetString("gatewayUrl")
-			d.gatewayURLs = append(d.gatewayURLs, &gatewayURLWatch{
-				gatewayID:  watcherNamespace,
-				gatewayURL: g,
-			})
-			util.Subscribe("gatewayUrl", func(key string, value string) {
-				for _, w := range d.gatewayURLs {
-					if w.gatewayID == watcherNamespace {
-						d.logger.Info("Updated gatewayUrl value for %s (new value: %s)", watcherNamespace, value)
-						w.gatewayURL = value
-						break
-					}
-				}
-				return
-			})
-		}
-		// ----
-	}
-	// -----
-	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLs, options, d.lastKnownService)
+		discoveredInstance.gatewayURL = d.gatewayURLs.get(d.configOptions, options, discoveredInstance.version, d.logger)
 
-	if err != nil {
-		if service != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
-		}
-
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
+		discoveredInstances = append(discoveredInstances, discoveredInstance)
 	}
 
-	d.lastKnownService = service
-	return service, nil
+	return discoveredInstances
 }
 
 // functions that aren't discoverySource methods
 
-// if service is not registered, performs registration. Otherwise perform ttl update
-func (d *consulDiscoverySource) run(retryDelay int64) {
-
-	var ok, firstTTL bool
-	if !d.serviceInstance.isRegistered {
-		ok = d.register(retryDelay)
-		if ok {
-			firstTTL = true
-			d.serviceInstance.isRegistered = true
-		}
-	} else {
-		ok = d.ttlUpdate(retryDelay)
-		if !ok {
-			d.serviceInstance.isRegistered = false
-		}
-	}
-
-	if !ok {
-		// Something went wrong with either registration or TTL update :(
-
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > d.maxRetryDelay {
-			newRetryDelay = d.maxRetryDelay
-		}
-		d.run(newRetryDelay)
-	} else {
-		// Everything is alright, either registration or TTL update was successful :)
-
-		// Note: Perform a TTL update immediately after registration
-		// registering with Consul does not assume successful TTL update and has to be done manually
-		// immediately after registration)
-		if !firstTTL {
-			time.Sleep(time.Duration(d.options.Discovery.PingInterval) * time.Second)
-			firstTTL = false
-		}
-		d.run(d.startRetryDelay)
-	}
-
-}
-
-func (d *consulDiscoverySource) register(retryDelay int64) bool {
-	inst := d.serviceInstance
-
-	if d.isServiceRegistered() && inst.singleton {
-		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true")
-		return false
-	}
-
-	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, d.options.Server.HTTP.Address, d.options.Server.HTTP.Port)
+func (d *consulDiscoverySource) register(inst *consulServiceInstance) bool {
+	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, inst.options.Server.HTTP.Address, inst.options.Server.HTTP.Port)
 
 	agentRegistration := api.AgentServiceRegistration{
-		Port: d.options.Server.HTTP.Port,
-		ID:   inst.id,
-		Name: inst.name,
-		Tags: []string{d.protocol, inst.versionTag},
+		Port:            inst.options.Server.HTTP.Port,
+		ID:              inst.id,
+		Name:            inst.name,
+		Tags:            []string{d.protocol, inst.versionTag},
+		Meta:            d.serviceMeta(inst),
+		TaggedAddresses: d.serviceTaggedAddresses(inst),
 		Check: &api.AgentServiceCheck{
-			CheckID: "check-" + inst.id,
-			TTL:     strconv.FormatInt(d.options.Discovery.TTL, 10) + "s",
+			CheckID:                        "check-" + inst.id,
+			TTL:                            strconv.FormatInt(inst.options.Discovery.TTL, 10) + "s",
 			DeregisterCriticalServiceAfter: strconv.FormatInt(10, 10) + "s",
 		},
 	}
 
-	if d.options.Server.HTTP.Address != "" {
-		agentRegistration.Address = d.options.Server.HTTP.Address
+	if inst.options.Server.HTTP.Address != "" {
+		agentRegistration.Address = inst.options.Server.HTTP.Address
+	}
+
+	if inst.connect != nil {
+		agentRegistration.Connect = &api.AgentServiceConnect{
+			SidecarService: &api.AgentServiceRegistration{
+				Proxy: &api.AgentServiceConnectProxyConfig{
+					Upstreams: connectUpstreams(inst),
+				},
+			},
+		}
 	}
 
 	err := d.client.Agent().ServiceRegister(&agentRegistration)
 
 	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
+		d.logger.Error("Service registration failed: %s", err.Error())
 		return false
 	}
 
@@ -323,8 +564,8 @@ func (d *consulDiscoverySource) register(retryDelay int64) bool {
 	return true
 }
 
-func (d *consulDiscoverySource) ttlUpdate(retryDelay int64) bool {
-	inst := d.serviceInstance
+// returns ok=true if TTL was updated and expired=true if the agent does not know the service check anymore
+func (d *consulDiscoverySource) ttlUpdate(inst *consulServiceInstance) (ok bool, expired bool) {
 	//d.logger.Verbose("Updating TTL for service %s", inst.id)
 
 	err := d.client.Agent().UpdateTTL(
@@ -333,29 +574,208 @@ func (d *consulDiscoverySource) ttlUpdate(retryDelay int64) bool {
 		"passing")
 
 	if err != nil {
-		d.logger.Error("TTL update failed, error: %s, retry delay: %d ms", inst.id, err.Error(), retryDelay)
-		return false
+		d.logger.Error("TTL update failed for service %s, error: %s", inst.id, err.Error())
+		return false, isConsulCheckNotFound(err)
 	}
 
 	d.logger.Verbose("TTL update for service %s", inst.id)
-	return true
+	return true, false
+}
+
+// lock, held by a Consul session. Session is invalidated if it is not renewed within TTL, which
+// releases the lock.
+type consulLock struct {
+	client *api.Client
+
+	key       string
+	value     string
+	ttl       time.Duration
+	sessionID string
 }
 
-// returns true if there are any services of this kind (env+name) registered
-func (d *consulDiscoverySource) isServiceRegistered() bool {
-	reg := d.serviceInstance
-	serviceEntries, _, err := d.client.Health().Service(reg.id, "", true, nil)
+func (l *consulLock) tryAcquire() (bool, error) {
+	if l.sessionID == "" {
+		ttl := l.ttl
+		if ttl < 10*time.Second {
+			ttl = 10 * time.Second // minimum session TTL allowed by Consul
+		}
+		sessionID, _, err := l.client.Session().Create(&api.SessionEntry{
+			Name:     "kumuluzee-lock-" + l.key,
+			TTL:      ttl.String(),
+			Behavior: api.SessionBehaviorDelete,
+		}, nil)
+		if err != nil {
+			return false, err
+		}
+		l.sessionID = sessionID
+	}
+
+	acquired, _, err := l.client.KV().Acquire(&api.KVPair{
+		Key:     l.key,
+		Value:   []byte(l.value),
+		Session: l.sessionID,
+	}, nil)
+	if err != nil || !acquired {
+		// standby does not renew its session, destroy it and create a new one next time, so that the session
+		// does not expire between attempts. Error is ignored, since the session may be invalidated already.
+		l.client.Session().Destroy(l.sessionID, nil)
+		l.sessionID = ""
+		return false, err
+	}
 
+	return true, nil
+}
+
+func (l *consulLock) renew() error {
+	entry, _, err := l.client.Session().Renew(l.sessionID, nil)
 	if err != nil {
-		d.logger.Warning("isServiceRegistered() failed: %s", err.Error())
-		return false
+		return err
+	}
+	if entry == nil {
+		// session was invalidated, and the lock with it
+		l.sessionID = ""
+		return errLockLost
 	}
+	return nil
+}
+
+func (l *consulLock) release() error {
+	_, _, err := l.client.KV().Release(&api.KVPair{
+		Key:     l.key,
+		Session: l.sessionID,
+	}, nil)
 
-	return len(serviceEntries) > 0
+	// destroying the session releases the lock as well, in case releasing failed
+	if _, dErr := l.client.Session().Destroy(l.sessionID, nil); dErr != nil && err == nil {
+		err = dErr
+	}
+	l.sessionID = ""
+
+	return err
+}
+
+// list of known datacenters, ordered by estimated round trip time from the local agent. The list is cached,
+// since it rarely changes. Safe for concurrent use.
+type nearestDatacenters struct {
+	mutex       sync.Mutex
+	datacenters []string
+	updated     time.Time
+}
+
+// maximum age of the cached list of datacenters
+const nearestDatacentersMaxAge = time.Minute
+
+func (n *nearestDatacenters) get(client *api.Client) ([]string, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.datacenters != nil && time.Since(n.updated) < nearestDatacentersMaxAge {
+		return n.datacenters, nil
+	}
+
+	// Consul returns datacenters sorted by estimated round trip time, using network coordinates
+	datacenters, err := client.Catalog().Datacenters()
+	if err != nil {
+		if n.datacenters != nil {
+			return n.datacenters, nil // use previous list until the catalog is reachable again
+		}
+		return nil, err
+	}
+	n.datacenters = datacenters
+	n.updated = time.Now()
+	return n.datacenters, nil
 }
 
 // functions that aren't discoverySource methods or consulDiscoverySource methods
 
+// returns true if error was returned because the agent does not know the check (e.g. after agent restart
+// or when the service was deregistered as critical)
+func isConsulCheckNotFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "404") ||
+		strings.Contains(msg, "Unknown check") ||
+		strings.Contains(msg, "does not have associated TTL")
+}
+
+// returns service meta of service instance, holding its protocol and base path
+func (d *consulDiscoverySource) serviceMeta(inst *consulServiceInstance) map[string]string {
+	meta := map[string]string{
+		consulMetaProtocol: d.protocol,
+	}
+	if basePath := basePathFromURL(inst.options.Server.BaseURL); basePath != "" {
+		meta[consulMetaBasePath] = basePath
+	}
+	return meta
+}
+
+// returns configured tagged addresses of service instance. Addresses without port use port of the service.
+func (d *consulDiscoverySource) serviceTaggedAddresses(inst *consulServiceInstance) map[string]api.ServiceAddress {
+	if len(d.taggedAddresses) == 0 {
+		return nil
+	}
+
+	taggedAddresses := make(map[string]api.ServiceAddress)
+	for tag, addr := range d.taggedAddresses {
+		serviceAddress := api.ServiceAddress{
+			Address: strings.Trim(addr, "[]"),
+			Port:    inst.options.Server.HTTP.Port,
+		}
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				serviceAddress = api.ServiceAddress{Address: host, Port: p}
+			}
+		}
+		taggedAddresses[tag] = serviceAddress
+	}
+	return taggedAddresses
+}
+
+// checks that Connect upstreams have a name and a valid local listener
+func validateConnectOptions(connect *ConnectOptions) error {
+	if connect == nil {
+		return nil
+	}
+	for _, u := range connect.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("Invalid Connect upstream: name is not set")
+		}
+		if u.LocalBindAddress != "" {
+			if _, err := normalizeServiceHost(u.LocalBindAddress); err != nil {
+				return fmt.Errorf("Invalid local bind address of Connect upstream %s: %s", u.Name, err.Error())
+			}
+		}
+		if u.LocalBindPort < 1 || u.LocalBindPort > 65535 {
+			return fmt.Errorf("Invalid local bind port of Connect upstream %s: %d", u.Name, u.LocalBindPort)
+		}
+	}
+	return nil
+}
+
+// returns Connect upstreams of service instance. Upstreams without environment are in the environment of the instance.
+func connectUpstreams(inst *consulServiceInstance) []api.Upstream {
+	var upstreams []api.Upstream
+	for _, u := range inst.connect.Upstreams {
+		environment := u.Environment
+		if environment == "" {
+			environment = inst.options.Env.Name
+		}
+		upstreams = append(upstreams, api.Upstream{
+			DestinationType:  api.UpstreamDestTypeService,
+			DestinationName:  environment + "-" + u.Name,
+			Datacenter:       u.Datacenter,
+			LocalBindAddress: u.LocalBindAddress,
+			LocalBindPort:    u.LocalBindPort,
+		})
+	}
+	return upstreams
+}
+
+// returns true if error was returned because the prepared query does not exist
+func isConsulQueryNotFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "404") || strings.Contains(msg, "Query not found")
+}
+
 func createConsulClient(address string) (*api.Client, error) {
 	clientConfig := api.DefaultConfig()
 	clientConfig.Address = address
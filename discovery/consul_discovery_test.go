@@ -0,0 +1,56 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import "testing"
+
+func TestValidateConnectOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []ConnectUpstream
+		valid     bool
+	}{
+		{"valid", []ConnectUpstream{{Name: "orders", LocalBindPort: 9191}}, true},
+		{"valid with address", []ConnectUpstream{{Name: "orders", LocalBindAddress: "::1", LocalBindPort: 9191}}, true},
+		{"no upstreams", nil, true},
+		{"missing name", []ConnectUpstream{{LocalBindPort: 9191}}, false},
+		{"missing port", []ConnectUpstream{{Name: "orders"}}, false},
+		{"negative port", []ConnectUpstream{{Name: "orders", LocalBindPort: -1}}, false},
+		{"port out of range", []ConnectUpstream{{Name: "orders", LocalBindPort: 65536}}, false},
+		{"invalid address", []ConnectUpstream{{Name: "orders", LocalBindAddress: "localhost:9191", LocalBindPort: 9191}}, false},
+		{"second upstream invalid", []ConnectUpstream{{Name: "orders", LocalBindPort: 9191}, {Name: "customers"}}, false},
+	}
+
+	for _, test := range tests {
+		err := validateConnectOptions(&ConnectOptions{Upstreams: test.upstreams})
+		if test.valid && err != nil {
+			t.Errorf("%s: validation failed: %s", test.name, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: validation succeeded, want error", test.name)
+		}
+	}
+
+	if err := validateConnectOptions(nil); err != nil {
+		t.Errorf("validation without Connect options failed: %s", err.Error())
+	}
+}
@@ -23,6 +23,10 @@
 package discovery
 
 import (
+	"fmt"
+	"net/http"
+	"time"
+
 	"github.com/kumuluz/kumuluzee-go-config/config"
 	"github.com/mc0239/logm"
 )
@@ -31,6 +35,12 @@ import (
 type Options struct {
 	// Additional configuration source to connect to. Possible values are: "consul", "etcd"
 	Extension string
+	// Extensions can be used instead of Extension to use multiple registries at once, e.g. during
+	// migration from one registry to another. Services are registered in all of them and discovered
+	// instances are merged. If the same instance is discovered in multiple registries, the one from the
+	// registry listed first is used. Precedence can be overridden with configuration key
+	// kumuluzee.discovery.precedence (comma separated extensions).
+	Extensions []string
 	// ConfigPath is a path to configuration file, including the configuration file name.
 	// Passing an empty string will default to config/config.yaml
 	ConfigPath string
@@ -38,6 +48,9 @@ type Options struct {
 	// will only output Warnings and Errors, and level 5 will only output errors.
 	// See package github.com/mc0239/logm for more details on logging and log levels.
 	LogLevel int
+	// BackoffPolicy used when retrying failed service registrations and TTL updates.
+	// If nil, ExponentialBackoff is configured with kumuluzee.discovery.retry.* configuration keys.
+	BackoffPolicy BackoffPolicy
 }
 
 // RegisterOptions is used when registering a service
@@ -62,8 +75,34 @@ type RegisterOptions struct {
 	// Can be overridden with configuration key kumuluzee.version
 	Version string
 	// If set to true, only once instance of service with the same name, version and environment is registered.
+	// Other instances stand by and take over when the registered instance is deregistered or its TTL expires.
 	// Default value is false.
 	Singleton bool
+	// Connect registers a Consul Connect sidecar proxy with the service, if set.
+	// Ignored by etcd discovery source.
+	Connect *ConnectOptions
+}
+
+// ConnectOptions is used when registering a Consul Connect sidecar proxy
+type ConnectOptions struct {
+	// Upstreams are services this service depends on. The sidecar proxy listens for connections to each of
+	// them locally. Local listeners are discovered with access type discovery.AccessTypeConnect.
+	Upstreams []ConnectUpstream
+}
+
+// ConnectUpstream is a dependency of the service, reached through the Consul Connect sidecar proxy
+type ConnectUpstream struct {
+	// Name of the service.
+	Name string
+	// Environment of the service. Default value is the environment of the registered service.
+	Environment string
+	// Datacenter of the service. Default value is the datacenter of the local agent.
+	Datacenter string
+	// LocalBindAddress is the address of the local listener. Default value is "127.0.0.1".
+	LocalBindAddress string
+	// LocalBindPort is the port of the local listener, between 1 and 65535. RegisterService returns an error
+	// for upstreams without a name or with an invalid local listener.
+	LocalBindPort int
 }
 
 // DiscoverOptions is used when discovering services
@@ -74,33 +113,128 @@ type DiscoverOptions struct {
 	// If value is not provided, it uses value from configuration with key kumuluzee.env.name
 	// If value is not specified and key in configuration does not exists, value defaults to 'dev'.
 	Environment string
+	// FallbackEnvironments are tried in order, if no instance with matching version is found in Environment.
+	// Environment, in which the service was discovered, is reported in DiscoveryResult.Environment.
+	FallbackEnvironments []string
 	// Version of the service to discover.
 	// Supported values are semantic version (semver) parseable versions/version ranges.
-	// Default value is "*", which resolves to highest deployed version.
+	// If value is not provided, it uses value from configuration with key kumuluzee.discovery.services.<name>.version
+	// or kumuluzee.discovery.default-version.
+	// If value is not specified and keys in configuration do not exist, value defaults to "*", which resolves
+	// to highest deployed version.
 	Version string
 	// AccessType defines, which URL gets injected.
-	// Supported values are constants discovery.AccessTypeGateway and discovery.AccessTypeDirect.
-	// Default value is discovery.AccessTypeGateway.
+	// Supported values are constants discovery.AccessTypeGateway, discovery.AccessTypeDirect and
+	// discovery.AccessTypeConnect.
+	// If value is not provided, it uses value from configuration with key kumuluzee.discovery.services.<name>.access-type
+	// or kumuluzee.discovery.default-access-type.
+	// If value is not specified and keys in configuration do not exist, value defaults to discovery.AccessTypeGateway.
 	AccessType string
+	// VersionSelection defines, which of the instances with version in range of Version are considered.
+	// Supported values are constants discovery.VersionSelectionLatest, discovery.VersionSelectionAll and
+	// discovery.VersionSelectionWeighted.
+	// Default value is discovery.VersionSelectionLatest. Weights from routing rules of the service take
+	// precedence, unless VersionWeights are set.
+	VersionSelection string
+	// VersionWeights are used with discovery.VersionSelectionWeighted. A weight is picked at random,
+	// proportionally to its Weight, among weights with instances in range, and an instance is picked
+	// from instances with version in its range.
+	VersionWeights []VersionWeight
+	// Datacenters are Consul datacenters to discover the service in, in order of preference. The next
+	// datacenter is tried, if there are no healthy instances of the service in the previous one.
+	// discovery.DatacentersNearest expands to all known datacenters, ordered by estimated round trip time from
+	// the local agent, starting with the local datacenter. Empty string stands for the local datacenter.
+	// If value is not provided, it uses value from configuration with key kumuluzee.discovery.consul.datacenters
+	// (comma separated). If value is not specified and key in configuration does not exist, only the local
+	// datacenter is used. Ignored by etcd discovery source.
+	Datacenters []string
+	// AddressTags are tags of Consul tagged addresses (e.g. "wan", "lan_ipv6"), preferred to the service address,
+	// in order. If value is not provided, it uses value from configuration with key
+	// kumuluzee.discovery.consul.address-tags (comma separated). Ignored by etcd discovery source.
+	AddressTags []string
+	// PreparedQuery is the name of a Consul prepared query, used to discover the service instead of querying
+	// healthy instances directly. Version and access type are applied to instances returned by the query.
+	// If the query does not exist, it is created for the service, sorting instances by round trip time from
+	// the agent and failing over to Datacenters. Ignored by etcd discovery source.
+	// If value is not provided, it uses value from configuration with key
+	// kumuluzee.discovery.services.<name>.prepared-query
+	PreparedQuery string
+	// Headers of the request, for which the service is discovered. They are matched against header-based
+	// overrides of routing rules, stored in key /environments/<env>/services/<name>/routingRules.
+	Headers http.Header
+}
+
+// VersionWeight defines relative amount of traffic for a version range, see DiscoverOptions.VersionWeights
+type VersionWeight struct {
+	// Version range, e.g. "1.2.x" or "1.3.0".
+	Version string
+	// Relative weight of the version range.
+	Weight int
+}
+
+// DiscoveryResult holds the result of service discovery
+type DiscoveryResult struct {
+	// URL of the discovered service.
+	URL string
+	// Environment, in which the service was discovered. Differs from DiscoverOptions.Environment, if the service
+	// was discovered in one of DiscoverOptions.FallbackEnvironments.
+	Environment string
+	// Datacenter, in which the service was discovered. Set only by Consul discovery source.
+	Datacenter string
+	// Stale is set to true if the service could not be discovered and URL is the last known URL,
+	// discovered with the same options.
+	Stale bool
 }
 
 // Possible access types for DiscoverOptions.AccessType
 const (
 	AccessTypeDirect  = "direct"
 	AccessTypeGateway = "gateway"
+	// AccessTypeConnect returns URL of the local listener of Consul Connect sidecar proxy for the service.
+	// Version is not applied, since the proxy routes connections. Supported only by Consul discovery source.
+	AccessTypeConnect = "connect"
+)
+
+// DatacentersNearest can be used in DiscoverOptions.Datacenters to fail over to all known datacenters,
+// ordered by estimated round trip time
+const DatacentersNearest = "*"
+
+// Possible version selections for DiscoverOptions.VersionSelection
+const (
+	// VersionSelectionLatest considers only instances of the highest version in range.
+	VersionSelectionLatest = "latest"
+	// VersionSelectionAll considers instances of all versions in range.
+	VersionSelectionAll = "all"
+	// VersionSelectionWeighted splits traffic between versions according to DiscoverOptions.VersionWeights.
+	VersionSelectionWeighted = "weighted"
 )
 
 // Util is used for registering and discovering services from a service discovery source.
-// Util should be initialized with discovery.New() function
+// Util should be initialized with discovery.New() function.
+// Util is safe for concurrent use by multiple goroutines.
 type Util struct {
-	discoverySource discoverySource
-	Logger          logm.Logm
+	discoverySource  discoverySource
+	configOptions    config.Options
+	discoverDefaults *discoverDefaults
+	Logger           logm.Logm
 }
 
 type discoverySource interface {
 	RegisterService(options RegisterOptions) (serviceID string, err error)
-	DeregisterService() error
-	DiscoverService(options DiscoverOptions) (string, error)
+	DeregisterService(serviceID string) error
+	DiscoverService(options DiscoverOptions) (DiscoveryResult, error)
+
+	// registers service with given instance id. If singletonLock is nil and options.Singleton is set, the source
+	// creates its own singleton lock.
+	registerService(options RegisterOptions, instanceID string, singletonLock distributedLock) (serviceID string, err error)
+	registeredServiceIDs() []string
+	registeredServiceConfiguration(serviceID string) (registerConfiguration, bool)
+	reregistrations(serviceID string) int64
+	newLock(key string, value string, ttl time.Duration) distributedLock
+	discoverInstances(options DiscoverOptions) ([]discoveredService, error)
+	getRoutingRules(options DiscoverOptions) *routingRules
+	putValue(key string, value string) error
+	deleteValue(key string) error
 }
 
 // New instantiates Util struct with initialized service discovery
@@ -111,42 +245,167 @@ func New(options Options) Util {
 
 	var src discoverySource
 
-	if options.Extension == "consul" {
-		// TODO: potential mixup between cofig.Options and (discovery.)Options
-		src = newConsulDiscoverySource(config.Options{
-			Extension:  options.Extension,
-			ConfigPath: options.ConfigPath,
-			LogLevel:   options.LogLevel,
-		}, &lgr)
-	} else if options.Extension == "etcd" {
-		src = newEtcdDiscoverySource(config.Options{
-			Extension:  options.Extension,
-			ConfigPath: options.ConfigPath,
-			LogLevel:   options.LogLevel,
-		}, &lgr)
-	} else {
-		lgr.Error("Specified discovery source extension is invalid.")
+	extensions := options.Extensions
+	if options.Extension != "" {
+		extensions = append([]string{options.Extension}, extensions...)
+	}
+	extensions = federationPrecedence(options.ConfigPath, extensions)
+	if len(extensions) == 0 {
+		extensions = []string{""}
+	}
+
+	// TODO: potential mixup between cofig.Options and (discovery.)Options
+	confOptions := config.Options{
+		Extension:  extensions[0],
+		ConfigPath: options.ConfigPath,
+		LogLevel:   options.LogLevel,
+	}
+
+	var sources []discoverySource
+	for _, extension := range extensions {
+		extConfOptions := confOptions
+		extConfOptions.Extension = extension
+
+		if extension == "consul" {
+			sources = append(sources, newConsulDiscoverySource(extConfOptions, options.BackoffPolicy, &lgr))
+		} else if extension == "etcd" {
+			sources = append(sources, newEtcdDiscoverySource(extConfOptions, options.BackoffPolicy, &lgr))
+		} else {
+			lgr.Error("Specified discovery source extension is invalid.")
+		}
+	}
+
+	if len(sources) == 1 {
+		src = sources[0]
+	} else if len(sources) > 1 {
+		src = newFederatedDiscoverySource(confOptions, sources, &lgr)
 	}
 
 	k := Util{
 		src,
+		confOptions,
+		loadDiscoverDefaults(confOptions, &lgr),
 		lgr,
 	}
 
 	return k
 }
 
-// RegisterService registers service using service discovery client with given RegisterOptions
+// RegisterService registers service using service discovery client with given RegisterOptions.
+// Multiple services can be registered with the same Util, each one is kept registered independently.
+// Returned service id can be used to deregister the service.
 func (d Util) RegisterService(options RegisterOptions) (string, error) {
 	return d.discoverySource.RegisterService(options)
 }
 
-// DeregisterService removes service from the registry (deregisters).
-func (d Util) DeregisterService() error {
-	return d.discoverySource.DeregisterService()
+// DeregisterService removes service with given id from the registry (deregisters).
+func (d Util) DeregisterService(serviceID string) error {
+	return d.discoverySource.DeregisterService(serviceID)
+}
+
+// DeregisterAllServices removes all services, registered with this Util, from the registry.
+// If deregistration of any service fails, the last error is returned.
+func (d Util) DeregisterAllServices() (err error) {
+	for _, id := range d.discoverySource.registeredServiceIDs() {
+		if e := d.discoverySource.DeregisterService(id); e != nil {
+			d.Logger.Error("Service deregistration failed, id=%s: %s", id, e.Error())
+			err = e
+		}
+	}
+	return
+}
+
+// Reregistrations returns how many times the service with given id had to be registered again,
+// because its registration expired or TTL updates failed. A growing count indicates flapping registration.
+func (d Util) Reregistrations(serviceID string) int64 {
+	return d.discoverySource.reregistrations(serviceID)
 }
 
-// DiscoverService discovery services using service discovery client with given RegisterOptions
+// DiscoverService discovers services using service discovery client with given DiscoverOptions.
+// If the service cannot be discovered, last known URL of the service discovered with the same options
+// is returned. Use Discover to find out whether the returned URL is stale.
 func (d Util) DiscoverService(options DiscoverOptions) (string, error) {
+	d.discoverDefaults.fill(&options, &d.Logger)
+	result, err := d.discoverySource.DiscoverService(options)
+	return result.URL, err
+}
+
+// Discover discovers services using service discovery client with given DiscoverOptions, like DiscoverService.
+// Returned DiscoveryResult also reports whether the URL was taken from the last known services.
+func (d Util) Discover(options DiscoverOptions) (DiscoveryResult, error) {
+	d.discoverDefaults.fill(&options, &d.Logger)
 	return d.discoverySource.DiscoverService(options)
 }
+
+// returns URLs of all instances matching options, for consumers that balance between instances themselves.
+// If access type is gateway and the gateway URL of instance's version is set, the gateway URL is returned
+// instead. With weighted version selection, weights are not applied: instances in range of Version and of any
+// version weight with positive weight are returned.
+func (d Util) discoverURLs(options DiscoverOptions) ([]string, error) {
+	d.discoverDefaults.fill(&options, &d.Logger)
+	fillDefaultDiscoverOptions(&options)
+
+	if options.AccessType == AccessTypeConnect {
+		// the sidecar proxy balances between instances
+		result, err := d.discoverySource.DiscoverService(options)
+		if err != nil {
+			return nil, err
+		}
+		return []string{result.URL}, nil
+	}
+
+	weighted := options.VersionSelection == VersionSelectionWeighted
+	if weighted {
+		if len(options.VersionWeights) == 0 {
+			return nil, errNoVersionWeights
+		}
+		// weights only apply when picking a single instance
+		options.VersionSelection = VersionSelectionAll
+	}
+
+	var instances []discoveredService
+	for _, environment := range discoverEnvironments(options) {
+		envOptions := options
+		envOptions.Environment = environment
+
+		discoveredInstances, err := d.discoverySource.discoverInstances(envOptions)
+		if err != nil {
+			return nil, err
+		}
+		instances, err = selectServiceInstances(discoveredInstances, envOptions)
+		if err != nil {
+			return nil, err
+		}
+		if weighted {
+			instances, err = extractServicesInWeightedRanges(instances, options.VersionWeights)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(instances) > 0 {
+			break
+		}
+	}
+	if len(instances) == 0 {
+		return nil, errNoMatchingService
+	}
+
+	var urls []string
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		instanceURL := instance.directURL
+		if options.AccessType == AccessTypeGateway && instance.gatewayURL != "" {
+			instanceURL = instance.gatewayURL
+		}
+		if instanceURL != "" && !seen[instanceURL] {
+			seen[instanceURL] = true
+			urls = append(urls, instanceURL)
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("No service found (no service with URL)")
+	}
+
+	return urls, nil
+}
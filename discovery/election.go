@@ -0,0 +1,116 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Leadership is returned by Util.Campaign when the instance becomes the leader of an election.
+// Leadership is safe for concurrent use.
+type Leadership interface {
+	// IsLeader returns true while the instance is still the leader.
+	IsLeader() bool
+	// Resign gives up leadership, so that another instance can be elected.
+	Resign() error
+	// Lost returns a channel, which is closed when leadership ends, either because it could not be
+	// renewed in time or because of Resign.
+	Lost() <-chan struct{}
+}
+
+type leadership struct {
+	lock *heldLock
+}
+
+func (l *leadership) IsLeader() bool {
+	return l.lock.isHeld()
+}
+
+func (l *leadership) Resign() error {
+	return l.lock.release()
+}
+
+func (l *leadership) Lost() <-chan struct{} {
+	return l.lock.lost
+}
+
+// Campaign blocks until this instance is elected as the leader of election with given name, or until
+// ctx is done. Elections are held among instances of the same service and environment, configured with
+// keys kumuluzee.name and kumuluzee.env.name or taken from the service registered with this Util, and stored
+// under /environments/<env>/services/<name>/elections/<electionName>. Leadership expires if it is not renewed
+// within TTL of the service, configured with key kumuluzee.discovery.ttl.
+func (d Util) Campaign(ctx context.Context, electionName string) (Leadership, error) {
+	regconf, err := d.lockServiceConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	candidateID, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("/environments/%s/services/%s/elections/%s", regconf.Env.Name, regconf.Name, electionName)
+	ttl := time.Duration(regconf.Discovery.TTL) * time.Second
+
+	d.Logger.Verbose("Campaigning in election %s as %s", key, candidateID.String())
+	lock, err := acquireLock(ctx, d.discoverySource.newLock(key, candidateID.String(), ttl), ttl, &d.Logger)
+	if err != nil {
+		return nil, err
+	}
+	d.Logger.Info("Elected as leader in election %s", key)
+
+	return &leadership{lock: lock}, nil
+}
+
+// returns configuration of the service, whose instances share locks and elections. Name and environment
+// are read from configuration keys kumuluzee.name and kumuluzee.env.name. If name is not configured,
+// configuration of the service registered with this Util is used.
+func (d Util) lockServiceConfiguration() (registerConfiguration, error) {
+	regconf := loadServiceRegisterConfiguration(d.configOptions, RegisterOptions{})
+	if regconf.Name != "" {
+		return regconf, nil
+	}
+
+	var registered registerConfiguration
+	found := false
+	for _, id := range d.discoverySource.registeredServiceIDs() {
+		conf, ok := d.discoverySource.registeredServiceConfiguration(id)
+		if !ok {
+			continue
+		}
+		if found && (registered.Name != conf.Name || registered.Env.Name != conf.Env.Name) {
+			return regconf, fmt.Errorf("Multiple services are registered, set configuration key kumuluzee.name")
+		}
+		registered = conf
+		found = true
+	}
+
+	if !found {
+		return regconf, fmt.Errorf("Service name is not configured, set configuration key kumuluzee.name or register the service first")
+	}
+	return registered, nil
+}
@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import "testing"
+
+// discovery source with registered services, other methods are not implemented
+type registeredServicesSource struct {
+	discoverySource
+	services map[string]registerConfiguration
+}
+
+func (s registeredServicesSource) registeredServiceIDs() []string {
+	var ids []string
+	for id := range s.services {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s registeredServicesSource) registeredServiceConfiguration(serviceID string) (registerConfiguration, bool) {
+	conf, ok := s.services[serviceID]
+	return conf, ok
+}
+
+func TestLockServiceConfiguration(t *testing.T) {
+	service := func(name string, env string) registerConfiguration {
+		var conf registerConfiguration
+		conf.Name = name
+		conf.Env.Name = env
+		return conf
+	}
+
+	tests := []struct {
+		name     string
+		services map[string]registerConfiguration
+		want     string
+		wantErr  bool
+	}{
+		{"no services", nil, "", true},
+		{"single service", map[string]registerConfiguration{"a": service("worker", "dev")}, "worker", false},
+		{"same service registered twice", map[string]registerConfiguration{
+			"a": service("worker", "dev"),
+			"b": service("worker", "dev"),
+		}, "worker", false},
+		{"different services", map[string]registerConfiguration{
+			"a": service("worker", "dev"),
+			"b": service("scheduler", "dev"),
+		}, "", true},
+		{"different environments", map[string]registerConfiguration{
+			"a": service("worker", "dev"),
+			"b": service("worker", "prod"),
+		}, "", true},
+	}
+
+	for _, test := range tests {
+		util := Util{discoverySource: registeredServicesSource{services: test.services}}
+		conf, err := util.lockServiceConfiguration()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got service %s, want error", test.name, conf.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed: %s", test.name, err.Error())
+		} else if conf.Name != test.want {
+			t.Errorf("%s: got service %s, want %s", test.name, conf.Name, test.want)
+		}
+	}
+}
@@ -28,8 +28,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/blang/semver"
-
 	"github.com/kumuluz/kumuluzee-go-config/config"
 	"github.com/mc0239/logm"
 	uuid "github.com/satori/go.uuid"
@@ -41,31 +39,29 @@ type etcdDiscoverySource struct {
 	client   *client.Client
 	kvClient client.KeysAPI
 
-	startRetryDelay int64
-	maxRetryDelay   int64
+	backoffPolicy BackoffPolicy
+
+	configOptions config.Options // passed when calling new...()
 
-	configOptions   config.Options         // passed when calling new...()
-	options         *registerConfiguration // loaded as config bundle
-	serviceInstance *etcdServiceInstance
+	serviceInstances serviceInstances
 
-	lastKnownService string // last known service from discovery
-	gatewayURLs      []*gatewayURLWatch
+	lastKnownServices lastKnownServices // last known services from discovery
+	gatewayURLs       gatewayURLWatches
+	routingRules      routingRulesWatches
 
 	logger *logm.Logm
 }
 
-// holds service instance configuration and state
+// holds etcd specific service instance configuration and state
 type etcdServiceInstance struct {
-	isRegistered bool
-
 	id         string
 	etcdKeyDir string
-	serviceURL string
+	serviceURL string // only accessed from the run loop
 
-	singleton bool
+	options *registerConfiguration // loaded as config bundle
 }
 
-func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discoverySource {
+func newEtcdDiscoverySource(options config.Options, backoffPolicy BackoffPolicy, logger *logm.Logm) discoverySource {
 	var d etcdDiscoverySource
 	logger.Verbose("Initializing etcd discovery source")
 	d.logger = logger
@@ -76,10 +72,13 @@ func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discovery
 		LogLevel:   logm.LvlWarning, // bit less logs from config
 	})
 
-	startRD, maxRD := getRetryDelays(conf)
-	d.startRetryDelay = startRD
-	d.maxRetryDelay = maxRD
-	logger.Verbose("start-retry-delay-ms=%d, max-retry-delay-ms=%d", d.startRetryDelay, d.maxRetryDelay)
+	if backoffPolicy == nil {
+		backoffPolicy = loadBackoffPolicy(conf, logger)
+	}
+	d.backoffPolicy = backoffPolicy
+
+	d.lastKnownServices.maxAge = getLastKnownServiceMaxAge(conf)
+	startDiscoverySnapshots(conf, &d.lastKnownServices, logger)
 
 	var etcdAddresses string
 	if addr, ok := conf.GetString("kumuluzee.discovery.etcd.hosts"); ok {
@@ -100,58 +99,127 @@ func newEtcdDiscoverySource(options config.Options, logger *logm.Logm) discovery
 }
 
 func (d *etcdDiscoverySource) RegisterService(options RegisterOptions) (serviceID string, err error) {
+	uuid4, err := uuid.NewV4()
+	if err != nil {
+		d.logger.Error("Generating service id failed: %s", err.Error())
+		return "", err
+	}
+
+	return d.registerService(options, uuid4.String(), nil)
+}
+
+func (d *etcdDiscoverySource) registerService(options RegisterOptions, instanceID string, singletonLock distributedLock) (serviceID string, err error) {
 	regconf := loadServiceRegisterConfiguration(d.configOptions, options)
-	d.options = &regconf
+	if err := validateServiceRegisterConfiguration(&regconf); err != nil {
+		d.logger.Error("Service registration failed: %s", err.Error())
+		return "", err
+	}
+	if regconf.Server.BaseURL == "" {
+		// TODO: if base-url not defined, assume URL from system network interface?
+		err := fmt.Errorf("No base-url provided, set configuration key kumuluzee.server.base-url")
+		d.logger.Error("Service registration failed: %s", err.Error())
+		return "", err
+	}
 
-	d.serviceInstance = &etcdServiceInstance{
-		singleton: options.Singleton,
+	inst := &etcdServiceInstance{
+		id:      instanceID,
+		options: &regconf,
 	}
 
-	uuid4, err := uuid.NewV4()
-	if err != nil {
-		d.logger.Error(err.Error())
+	inst.etcdKeyDir = fmt.Sprintf("/environments/%s/services/%s/%s/instances/%s",
+		regconf.Env.Name, regconf.Name, regconf.Version, inst.id)
+
+	registration := &serviceInstance{
+		id:        inst.id,
+		options:   &regconf,
+		register:  func() bool { return d.register(inst) },
+		ttlUpdate: func() (bool, bool) { return d.ttlUpdate(inst) },
+		deregister: func() error {
+			_, err := d.kvClient.Delete(context.Background(),
+				inst.etcdKeyDir,
+				&client.DeleteOptions{
+					Recursive: true,
+					Dir:       true,
+				})
+			return err
+		},
+	}
+	registration.singletonLock = singletonLock
+	if singletonLock == nil && options.Singleton {
+		registration.singletonLock = d.newLock(singletonLockKey(&regconf), inst.id,
+			time.Duration(regconf.Discovery.TTL)*time.Second)
 	}
 
-	d.serviceInstance.id = uuid4.String()
+	d.serviceInstances.start(registration, d.backoffPolicy, d.logger)
 
-	d.serviceInstance.etcdKeyDir = fmt.Sprintf("/environments/%s/services/%s/%s/instances/%s",
-		regconf.Env.Name, regconf.Name, regconf.Version, d.serviceInstance.id)
+	return inst.id, nil
+}
 
-	go d.run(d.startRetryDelay)
+func (d *etcdDiscoverySource) DeregisterService(serviceID string) error {
+	return d.serviceInstances.deregister(serviceID, d.logger)
+}
 
-	return d.serviceInstance.id, nil
+func (d *etcdDiscoverySource) registeredServiceIDs() []string {
+	return d.serviceInstances.ids()
 }
 
-func (d *etcdDiscoverySource) DeregisterService() error {
-	d.logger.Info("Service deregistration, id=%s", d.serviceInstance.id)
-	_, err := d.kvClient.Delete(context.Background(),
-		d.serviceInstance.etcdKeyDir,
-		&client.DeleteOptions{
-			Recursive: true,
-			Dir:       true,
-		})
+func (d *etcdDiscoverySource) registeredServiceConfiguration(serviceID string) (registerConfiguration, bool) {
+	return d.serviceInstances.configuration(serviceID)
+}
+
+func (d *etcdDiscoverySource) reregistrations(serviceID string) int64 {
+	return d.serviceInstances.reregistrations(serviceID)
+}
+
+func (d *etcdDiscoverySource) newLock(key string, value string, ttl time.Duration) distributedLock {
+	// etcd v2 API truncates TTL to whole seconds, round it up so that the key does not get TTL of 0
+	if rounded := ttl.Truncate(time.Second); rounded < ttl {
+		ttl = rounded + time.Second
+	}
+	return &etcdLock{
+		kvClient: d.kvClient,
+		key:      key,
+		value:    value,
+		ttl:      ttl,
+	}
+}
+
+func (d *etcdDiscoverySource) putValue(key string, value string) error {
+	_, err := d.kvClient.Set(context.Background(), key, value, nil)
+	return err
+}
+
+// deleting a key that does not exist is not an error, like with Consul KV
+func (d *etcdDiscoverySource) deleteValue(key string) error {
+	_, err := d.kvClient.Delete(context.Background(), key, nil)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
 	return err
 }
 
-func (d *etcdDiscoverySource) DiscoverService(options DiscoverOptions) (string, error) {
-	fillDefaultDiscoverOptions(&options)
+func (d *etcdDiscoverySource) DiscoverService(options DiscoverOptions) (DiscoveryResult, error) {
+	if options.AccessType == AccessTypeConnect {
+		return DiscoveryResult{}, fmt.Errorf("Access type %s is not supported by etcd discovery source", AccessTypeConnect)
+	}
+	return discoverService(d.discoverInstances, d.getRoutingRules, &d.lastKnownServices, options, d.logger)
+}
+
+func (d *etcdDiscoverySource) getRoutingRules(options DiscoverOptions) *routingRules {
+	return d.routingRules.get(d.configOptions, options, d.logger)
+}
 
+// extracts all services of all versions of given environment and name
+func (d *etcdDiscoverySource) discoverInstances(options DiscoverOptions) ([]discoveredService, error) {
 	kvPath := fmt.Sprintf("environments/%s/services/%s/", options.Environment, options.Value)
 
 	resp, err := d.kvClient.Get(context.Background(), kvPath, &client.GetOptions{
 		Recursive: true,
 	})
-
 	if err != nil {
-		if d.lastKnownService != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
-		}
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
+		return nil, err
 	}
 
-	// ----- extract all services of all versions of given environment and name
 	var discoveredInstances []discoveredService
 	// iterate all versions
 	for _, nodeVersion := range resp.Node.Nodes {
@@ -164,161 +232,95 @@ func (d *etcdDiscoverySource) DiscoverService(options DiscoverOptions) (string,
 				break
 			}
 		}
+		if instances == nil {
+			continue // no instances registered for this version
+		}
+
+		version, err := parseInstanceVersion(currentVersion)
+		if err != nil {
+			d.logger.Warning("semver parsing failed for: %s, error: %s", currentVersion, err.Error())
+			continue // skip this version, can't parse it
+		}
 
 		// iterate all instances
 		for _, instance := range instances.Nodes {
 			discoveredInstance := discoveredService{}
 			discoveredInstance.id = path.Base(instance.Key)
-
-			version, err := semver.ParseTolerant(currentVersion)
-			if err != nil {
-				d.logger.Warning("semver parsing failed for: %s, error: %s", currentVersion, err.Error())
-				break // break out of this version, can't parse it
-			}
 			discoveredInstance.version = version
 
 			for _, node := range instance.Nodes {
-				// fmt.Printf("key=%v value=%v", node.Key, node.Value)
-				if path.Base(node.Key) == "url" {
-					discoveredInstance.directURL = node.Value
+				if path.Base(node.Key) == "url" && node.Value != "" {
+					directURL, err := normalizeServiceURL(node.Value)
+					if err != nil {
+						d.logger.Warning("Invalid URL of service instance %s: %s", discoveredInstance.id, err.Error())
+						continue
+					}
+					discoveredInstance.directURL = directURL
 				}
 			}
 
-			discoveredInstances = append(discoveredInstances, discoveredInstance)
-
-			// ---- add a watch for gatewayUrl for discovering service (if not already made)
-			// TODO: this part is the same for both etcd & consul: make the code more DRY
-			watcherNamespace := fmt.Sprintf("/environments/%s/services/%s/%s", options.Environment, options.Value, discoveredInstance.version.String())
-
-			util := config.NewUtil(config.Options{
-				Extension:          d.configOptions.Extension,
-				ExtensionNamespace: watcherNamespace,
-				ConfigPath:         d.configOptions.ConfigPath,
-				LogLevel:           logm.LvlMute,
-			})
-
-			var hasWatch bool
-			for _, w := range d.gatewayURLs {
-				if w.gatewayID == watcherNamespace {
-					// watch already set :)
-					hasWatch = true
-					break
-				}
-			}
-			if !hasWatch {
-				// make a watch for this one!
-				d.logger.Info("Creating a gatewayUrl watch for %s", watcherNamespace)
-
-				g, _ := util.GetString("gatewayUrl")
-				d.gatewayURLs = append(d.gatewayURLs, &gatewayURLWatch{
-					gatewayID:  watcherNamespace,
-					gatewayURL: g,
-				})
-				util.Subscribe("gatewayUrl", func(key string, value string) {
-					for _, w := range d.gatewayURLs {
-						if w.gatewayID == watcherNamespace {
-							d.logger.Info("Updated gatewayUrl value for %s (new value: %s)", watcherNamespace, value)
-							w.gatewayURL = value
-							break
-						}
-					}
-					return
-				})
+			if discoveredInstance.directURL == "" {
+				// url key is written after the instance directory, skip instances that are not fully registered yet
+				d.logger.Verbose("Skipping service instance %s without URL", discoveredInstance.id)
+				continue
 			}
-			// ----
-		}
-	}
-	// -----
 
-	service, err := pickRandomServiceInstance(discoveredInstances, d.gatewayURLs, options, d.lastKnownService)
+			discoveredInstance.gatewayURL = d.gatewayURLs.get(d.configOptions, options, discoveredInstance.version, d.logger)
 
-	if err != nil {
-		if service != "" {
-			d.logger.Warning("Service discovery failed, using last known service. Error: %s", err.Error())
-			return d.lastKnownService, nil
+			discoveredInstances = append(discoveredInstances, discoveredInstance)
 		}
-
-		d.logger.Error("Service discovery failed: %s", err.Error())
-		return "", err
 	}
 
-	d.lastKnownService = service
-	return service, nil
+	return discoveredInstances, nil
 }
 
 // functions that aren't discoverySource methods
 
-// if service is not registered, performs registration. Otherwise perform ttl update
-func (d *etcdDiscoverySource) run(retryDelay int64) {
-
-	var ok bool
-	if !d.serviceInstance.isRegistered {
-		ok = d.register(retryDelay)
-		if ok {
-			d.serviceInstance.isRegistered = true
-		}
-	} else {
-		ok = d.ttlUpdate(retryDelay)
-		if !ok {
-			d.serviceInstance.isRegistered = false
-		}
-	}
-
-	if !ok {
-		// Something went wrong with either registration or TTL update :(
-
-		// sleep for current delay
-		time.Sleep(time.Duration(retryDelay) * time.Millisecond)
-		// exponentially extend retry delay, but keep it at most maxRetryDelay
-		newRetryDelay := retryDelay * 2
-		if newRetryDelay > d.maxRetryDelay {
-			newRetryDelay = d.maxRetryDelay
-		}
-		d.run(newRetryDelay)
-	} else {
-		// Everything is alright, either registration or TTL update was successful :)
-
-		time.Sleep(time.Duration(d.options.Discovery.PingInterval) * time.Second)
-		d.run(d.startRetryDelay)
-	}
-
-}
-
-func (d *etcdDiscoverySource) register(retryDelay int64) bool {
-	inst := d.serviceInstance
-
-	if d.isServiceRegistered() && inst.singleton {
-		d.logger.Error("Service of this kind is already registered, not registering with options.singleton set to true")
-		return false
-	}
+func (d *etcdDiscoverySource) register(inst *etcdServiceInstance) bool {
+	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, inst.options.Server.HTTP.Address, inst.options.Server.HTTP.Port)
 
-	d.logger.Info("Registering service: id=%s address=%s port=%d", inst.id, d.options.Server.HTTP.Address, d.options.Server.HTTP.Port)
+	inst.serviceURL = inst.options.Server.BaseURL
 
-	d.serviceInstance.serviceURL = d.options.Server.BaseURL
-	if d.serviceInstance.serviceURL == "" {
-		// TODO: if base-url not defined, assume URL from system network interface?
-		d.logger.Error("No base-url provided! Please provide base-url by setting a key kumuluzee.server.base-url in your configuration!")
-	}
+	ttl := time.Duration(inst.options.Discovery.TTL) * time.Second
 
 	// set TTL on instance directory
 	_, err := d.kvClient.Set(context.Background(),
-		d.serviceInstance.etcdKeyDir,
+		inst.etcdKeyDir,
 		"",
 		&client.SetOptions{
-			TTL: time.Duration(d.options.Discovery.TTL) * time.Second,
-			Dir: true,
+			TTL:       ttl,
+			Dir:       true,
+			PrevExist: client.PrevNoExist,
+		})
+	if isEtcdNodeExists(err) {
+		// directory has not expired yet (e.g. TTL update failed because of a network error), refresh it
+		_, err = d.kvClient.Set(context.Background(), inst.etcdKeyDir, "", &client.SetOptions{
+			TTL:       ttl,
+			Dir:       true,
+			PrevExist: client.PrevExist,
+			Refresh:   true,
 		})
+	}
 	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
+		d.logger.Error("Service registration failed: %s", err.Error())
 		return false
 	}
 
 	_, err = d.kvClient.Set(context.Background(),
-		d.serviceInstance.etcdKeyDir+"/url",
-		d.serviceInstance.serviceURL,
+		inst.etcdKeyDir+"/url",
+		inst.serviceURL,
 		nil)
 	if err != nil {
-		d.logger.Error(fmt.Sprintf("Service registration failed: %s", err.Error()))
+		d.logger.Error("Service registration failed: %s", err.Error())
+
+		// etcd v2 API has no transactions: remove the directory, so that there is no instance without URL
+		_, delErr := d.kvClient.Delete(context.Background(), inst.etcdKeyDir, &client.DeleteOptions{
+			Recursive: true,
+			Dir:       true,
+		})
+		if delErr != nil && !client.IsKeyNotFound(delErr) {
+			d.logger.Warning("Removing incomplete registration of service %s failed: %s", inst.id, delErr.Error())
+		}
 		return false
 	}
 
@@ -326,65 +328,98 @@ func (d *etcdDiscoverySource) register(retryDelay int64) bool {
 	return true
 }
 
-func (d *etcdDiscoverySource) ttlUpdate(retryDelay int64) bool {
-	inst := d.serviceInstance
+// returns ok=true if TTL was updated and expired=true if the instance directory does not exist anymore
+func (d *etcdDiscoverySource) ttlUpdate(inst *etcdServiceInstance) (ok bool, expired bool) {
 	// d.logger.Verbose("Updating TTL for service %s", inst.id)
 
 	_, err := d.kvClient.Set(context.Background(), inst.etcdKeyDir, "", &client.SetOptions{
-		TTL:       time.Duration(d.options.Discovery.TTL) * time.Second,
+		TTL:       time.Duration(inst.options.Discovery.TTL) * time.Second,
 		Dir:       true,
 		PrevExist: client.PrevExist,
 		Refresh:   true,
 	})
 
 	if err != nil {
-		d.logger.Error("TTL update failed, error: %s, retry delay: %d ms", inst.id, err.Error(), retryDelay)
-		return false
+		d.logger.Error("TTL update failed for service %s, error: %s", inst.id, err.Error())
+		return false, client.IsKeyNotFound(err)
 	}
 
 	d.logger.Verbose("TTL update for service %s", inst.id)
-	return true
+	return true, false
 }
 
-// returns true if there are any services of this kind (env+name) registered
-func (d *etcdDiscoverySource) isServiceRegistered() bool {
-	etcdKeyDir := fmt.Sprintf("/environments/%s/services/%s/%s/instances/",
-		d.options.Env.Name, d.options.Name, d.options.Version)
+// lock, held by a key with TTL. Key is created only if it does not exist and is refreshed only if
+// it still holds the value of this lock.
+type etcdLock struct {
+	kvClient client.KeysAPI
 
-	resp, err := d.kvClient.Get(context.Background(), etcdKeyDir, &client.GetOptions{
-		Recursive: true,
-	})
+	key   string
+	value string
+	ttl   time.Duration
+}
 
-	if err != nil {
-		d.logger.Warning("isServiceRegistered() failed: %s", err.Error())
-		return false
+func (l *etcdLock) tryAcquire() (bool, error) {
+	_, err := l.kvClient.Set(context.Background(), l.key, l.value, &client.SetOptions{
+		TTL:       l.ttl,
+		PrevExist: client.PrevNoExist,
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !isEtcdNodeExists(err) {
+		return false, err
 	}
 
-	for _, instance := range resp.Node.Nodes {
-		var URL string
-		var isActive = true
-
-		for _, node := range instance.Nodes {
-			if path.Base(node.Key) == "url" {
-				URL = node.Value
-			}
-			if path.Base(node.Key) == "status" {
-				if node.Value == "disabled" {
-					isActive = false
-				}
-			}
+	// lock may still be held by us, e.g. if renewing failed because of a network error
+	if err := l.renew(); err != nil {
+		if err == errLockLost {
+			return false, nil
 		}
+		return false, err
+	}
+	return true, nil
+}
 
-		if isActive && URL != "" {
-			return true
-		}
+func (l *etcdLock) renew() error {
+	_, err := l.kvClient.Set(context.Background(), l.key, "", &client.SetOptions{
+		TTL:       l.ttl,
+		PrevExist: client.PrevExist,
+		PrevValue: l.value,
+		Refresh:   true,
+	})
+	if isEtcdLockLost(err) {
+		return errLockLost
 	}
+	return err
+}
 
-	return false
+func (l *etcdLock) release() error {
+	_, err := l.kvClient.Delete(context.Background(), l.key, &client.DeleteOptions{
+		PrevValue: l.value,
+	})
+	if isEtcdLockLost(err) {
+		return nil // nothing to release
+	}
+	return err
 }
 
 // functions that aren't discoverySource methods or etcdDiscoverySource methods
 
+func isEtcdNodeExists(err error) bool {
+	if cErr, ok := err.(client.Error); ok {
+		return cErr.Code == client.ErrorCodeNodeExist
+	}
+	return false
+}
+
+// returns true if error means that the lock key does not exist or holds a different value
+func isEtcdLockLost(err error) bool {
+	if cErr, ok := err.(client.Error); ok {
+		return cErr.Code == client.ErrorCodeKeyNotFound || cErr.Code == client.ErrorCodeTestFailed
+	}
+	return false
+}
+
 func createEtcdClient(addresses string) (*client.Client, error) {
 	clientConfig := client.Config{
 		Endpoints: strings.Split(addresses, ","),
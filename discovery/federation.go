@@ -0,0 +1,372 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// discovery source, which registers services in all of its sources and merges their discovery results.
+// Sources are ordered by precedence: if the same instance is discovered in multiple sources, the instance
+// from the source with the highest precedence is used.
+type federatedDiscoverySource struct {
+	sources       []discoverySource
+	configOptions config.Options
+
+	mutex      sync.Mutex
+	serviceIDs map[string][]string // ids of registered services in each of the sources, by federated service id
+
+	lastKnownServices lastKnownServices // last known services from discovery
+
+	logger *logm.Logm
+}
+
+func newFederatedDiscoverySource(options config.Options, sources []discoverySource, logger *logm.Logm) discoverySource {
+	var d federatedDiscoverySource
+	logger.Verbose("Initializing federated discovery source")
+	d.logger = logger
+	d.sources = sources
+	d.configOptions = options
+
+	conf := config.NewUtil(config.Options{
+		ConfigPath: options.ConfigPath,
+		LogLevel:   logm.LvlWarning, // bit less logs from config
+	})
+
+	d.lastKnownServices.maxAge = getLastKnownServiceMaxAge(conf)
+	startDiscoverySnapshots(conf, &d.lastKnownServices, logger)
+
+	return &d
+}
+
+func (d *federatedDiscoverySource) RegisterService(options RegisterOptions) (serviceID string, err error) {
+	uuid4, err := uuid.NewV4()
+	if err != nil {
+		d.logger.Error("Generating service id failed: %s", err.Error())
+		return "", err
+	}
+
+	return d.registerService(options, uuid4.String(), nil)
+}
+
+// registers service in all sources with the same instance id, so that discovered instances can be deduplicated.
+// Returned service id is the id of the service in the source with the highest precedence. Singleton services
+// share a single lock, held in the source with the highest precedence, so that the same instance is registered
+// in all sources.
+func (d *federatedDiscoverySource) registerService(options RegisterOptions, instanceID string, singletonLock distributedLock) (serviceID string, err error) {
+	if singletonLock == nil && options.Singleton {
+		regconf := loadServiceRegisterConfiguration(d.configOptions, options)
+		singletonLock = d.sources[0].newLock(singletonLockKey(&regconf), instanceID,
+			time.Duration(regconf.Discovery.TTL)*time.Second)
+	}
+	var shared *sharedLock
+	if singletonLock != nil {
+		shared = &sharedLock{lock: singletonLock}
+	}
+
+	var ids []string
+	for _, src := range d.sources {
+		var lock distributedLock
+		if shared != nil {
+			lock = shared.handle()
+		}
+
+		id, err := src.registerService(options, instanceID, lock)
+		if err != nil {
+			// roll back, so that the service is registered either in all sources or in none
+			for i, registeredID := range ids {
+				if dErr := d.sources[i].DeregisterService(registeredID); dErr != nil {
+					d.logger.Warning("Service deregistration failed, id=%s: %s", registeredID, dErr.Error())
+				}
+			}
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+
+	d.mutex.Lock()
+	if d.serviceIDs == nil {
+		d.serviceIDs = make(map[string][]string)
+	}
+	d.serviceIDs[ids[0]] = ids
+	d.mutex.Unlock()
+
+	return ids[0], nil
+}
+
+func (d *federatedDiscoverySource) DeregisterService(serviceID string) error {
+	d.mutex.Lock()
+	ids, ok := d.serviceIDs[serviceID]
+	delete(d.serviceIDs, serviceID)
+	d.mutex.Unlock()
+
+	if !ok {
+		// not registered through this source, try deregistering in the source with the highest precedence
+		return d.sources[0].DeregisterService(serviceID)
+	}
+
+	var err error
+	for i, id := range ids {
+		if e := d.sources[i].DeregisterService(id); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *federatedDiscoverySource) registeredServiceIDs() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	ids := make([]string, 0, len(d.serviceIDs))
+	for id := range d.serviceIDs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// returned service ids are ids in the source with the highest precedence
+func (d *federatedDiscoverySource) registeredServiceConfiguration(serviceID string) (registerConfiguration, bool) {
+	return d.sources[0].registeredServiceConfiguration(serviceID)
+}
+
+// returns sum of re-registrations in all sources
+func (d *federatedDiscoverySource) reregistrations(serviceID string) int64 {
+	d.mutex.Lock()
+	ids, ok := d.serviceIDs[serviceID]
+	d.mutex.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	var count int64
+	for i, id := range ids {
+		count += d.sources[i].reregistrations(id)
+	}
+	return count
+}
+
+// locks are held in the source with the highest precedence
+func (d *federatedDiscoverySource) newLock(key string, value string, ttl time.Duration) distributedLock {
+	return d.sources[0].newLock(key, value, ttl)
+}
+
+// values are written to all sources, so that they can be read from any of them. If writing fails in any of the
+// sources, the last error is returned.
+func (d *federatedDiscoverySource) putValue(key string, value string) (err error) {
+	for _, src := range d.sources {
+		if e := src.putValue(key, value); e != nil {
+			d.logger.Warning("Writing key %s to one of federated sources failed: %s", key, e.Error())
+			err = e
+		}
+	}
+	return
+}
+
+func (d *federatedDiscoverySource) deleteValue(key string) (err error) {
+	for _, src := range d.sources {
+		if e := src.deleteValue(key); e != nil {
+			d.logger.Warning("Deleting key %s from one of federated sources failed: %s", key, e.Error())
+			err = e
+		}
+	}
+	return
+}
+
+func (d *federatedDiscoverySource) DiscoverService(options DiscoverOptions) (DiscoveryResult, error) {
+	if options.AccessType == AccessTypeConnect {
+		// local listeners are not discovered from instances, use the first source that knows them
+		var err error
+		for _, src := range d.sources {
+			var result DiscoveryResult
+			if result, err = src.DiscoverService(options); err == nil {
+				return result, nil
+			}
+		}
+		return DiscoveryResult{}, err
+	}
+	return discoverService(d.discoverInstances, d.getRoutingRules, &d.lastKnownServices, options, d.logger)
+}
+
+// returns routing rules from the source with the highest precedence, that has them set
+func (d *federatedDiscoverySource) getRoutingRules(options DiscoverOptions) *routingRules {
+	for _, src := range d.sources {
+		if rules := src.getRoutingRules(options); rules != nil {
+			return rules
+		}
+	}
+	return nil
+}
+
+// merges instances discovered in all sources. Instances with the same id are discovered only once, from the
+// source with the highest precedence. Fails only if discovery fails in all sources.
+func (d *federatedDiscoverySource) discoverInstances(options DiscoverOptions) ([]discoveredService, error) {
+	var discoveredInstances []discoveredService
+	var lastErr error
+	failed := 0
+
+	seen := make(map[string]bool)
+	for _, src := range d.sources {
+		instances, err := src.discoverInstances(options)
+		if err != nil {
+			d.logger.Warning("Service discovery in one of federated sources failed: %s", err.Error())
+			lastErr = err
+			failed++
+			continue
+		}
+
+		for _, instance := range instances {
+			if seen[instance.id] {
+				continue
+			}
+			seen[instance.id] = true
+			discoveredInstances = append(discoveredInstances, instance)
+		}
+	}
+
+	if failed == len(d.sources) {
+		return nil, lastErr
+	}
+	return discoveredInstances, nil
+}
+
+// distributedLock shared by registrations of the same instance in multiple sources. Each registration uses
+// its own handle: the lock is acquired with the first handle and released with the last one, and is lost for
+// all handles at once. Safe for concurrent use.
+type sharedLock struct {
+	lock distributedLock
+
+	mutex      sync.Mutex // guards lock and fields below
+	holders    int        // number of handles holding the lock
+	generation int        // incremented when the lock is lost, so that handles holding it notice
+}
+
+type sharedLockHandle struct {
+	shared     *sharedLock
+	held       bool
+	generation int // generation of shared lock, when the handle acquired it
+}
+
+func (s *sharedLock) handle() distributedLock {
+	return &sharedLockHandle{shared: s}
+}
+
+func (h *sharedLockHandle) tryAcquire() (bool, error) {
+	s := h.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if h.held && h.generation == s.generation {
+		// registration gave up the lock after failed renewals, check it again with the underlying lock
+		s.holders--
+	}
+	h.held = false
+
+	if s.holders == 0 {
+		acquired, err := s.lock.tryAcquire()
+		if err != nil || !acquired {
+			return false, err
+		}
+	}
+	s.holders++
+	h.held = true
+	h.generation = s.generation
+	return true, nil
+}
+
+func (h *sharedLockHandle) renew() error {
+	s := h.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !h.held || h.generation != s.generation {
+		h.held = false
+		return errLockLost
+	}
+
+	err := s.lock.renew()
+	if err == errLockLost {
+		s.holders = 0
+		s.generation++
+		h.held = false
+	}
+	return err
+}
+
+func (h *sharedLockHandle) release() error {
+	s := h.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !h.held || h.generation != s.generation {
+		h.held = false
+		return nil
+	}
+
+	h.held = false
+	s.holders--
+	if s.holders == 0 {
+		return s.lock.release()
+	}
+	return nil
+}
+
+// returns extensions without duplicates, ordered by precedence configured with key kumuluzee.discovery.precedence.
+// Extensions not listed in configuration keep their order and follow the listed ones.
+func federationPrecedence(configPath string, extensions []string) []string {
+	conf := config.NewUtil(config.Options{
+		ConfigPath: configPath,
+		LogLevel:   logm.LvlWarning, // bit less logs from config
+	})
+
+	var ordered []string
+	added := make(map[string]bool)
+	add := func(extension string) {
+		if extension != "" && !added[extension] {
+			added[extension] = true
+			ordered = append(ordered, extension)
+		}
+	}
+
+	if precedence, ok := conf.GetString("kumuluzee.discovery.precedence"); ok {
+		for _, extension := range strings.Split(precedence, ",") {
+			extension = strings.TrimSpace(extension)
+			for _, e := range extensions {
+				if e == extension {
+					add(extension)
+				}
+			}
+		}
+	}
+	for _, extension := range extensions {
+		add(extension)
+	}
+
+	return ordered
+}
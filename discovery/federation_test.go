@@ -0,0 +1,72 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import "testing"
+
+func TestSharedLock(t *testing.T) {
+	registry := newFakeRegistry()
+
+	a := &sharedLock{lock: registry.newLock("singleton", "a")}
+	aConsul, aEtcd := a.handle(), a.handle()
+	b := &sharedLock{lock: registry.newLock("singleton", "b")}
+	bConsul, bEtcd := b.handle(), b.handle()
+
+	mustAcquire := func(name string, lock distributedLock, want bool) {
+		t.Helper()
+		if acquired, err := lock.tryAcquire(); err != nil || acquired != want {
+			t.Fatalf("%s: tryAcquire = %v, %v, want %v", name, acquired, err, want)
+		}
+	}
+
+	// instance a holds the lock in all sources, b stands by in all sources
+	mustAcquire("a consul", aConsul, true)
+	mustAcquire("b etcd", bEtcd, false)
+	mustAcquire("a etcd", aEtcd, true)
+	mustAcquire("b consul", bConsul, false)
+
+	// the lock is released only when all handles release it
+	if err := aConsul.release(); err != nil {
+		t.Fatal(err)
+	}
+	mustAcquire("b consul", bConsul, false)
+	if err := aEtcd.renew(); err != nil {
+		t.Fatalf("renewing lock failed: %s", err.Error())
+	}
+	if err := aEtcd.release(); err != nil {
+		t.Fatal(err)
+	}
+	mustAcquire("b consul", bConsul, true)
+	mustAcquire("b etcd", bEtcd, true)
+
+	// losing the lock is noticed by all handles
+	registry.mutex.Lock()
+	registry.locks["singleton"] = "c"
+	registry.mutex.Unlock()
+	if err := bConsul.renew(); err != errLockLost {
+		t.Fatalf("renew = %v, want errLockLost", err)
+	}
+	if err := bEtcd.renew(); err != errLockLost {
+		t.Fatalf("renew = %v, want errLockLost", err)
+	}
+	mustAcquire("b etcd", bEtcd, false)
+}
@@ -0,0 +1,78 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+)
+
+// SetGatewayURL sets gateway URL of given service version in given environment. Consumers discovering the
+// service with gateway access type are given this URL instead of URLs of service instances. The URL is stored
+// under /environments/<env>/services/<name>/<version>/gatewayUrl in all registries of this Util, and is
+// validated and normalized like base URLs of registered services.
+func (d Util) SetGatewayURL(env string, name string, version string, gatewayURL string) error {
+	key, err := gatewayURLKey(env, name, version)
+	if err != nil {
+		return err
+	}
+	normalized, err := normalizeServiceURL(gatewayURL)
+	if err != nil {
+		return fmt.Errorf("Invalid gateway URL: %s", err.Error())
+	}
+
+	if err := d.discoverySource.putValue(key, normalized); err != nil {
+		d.Logger.Error("Setting gateway URL %s failed: %s", key, err.Error())
+		return err
+	}
+	d.Logger.Info("Gateway URL set, key=%s url=%s", key, normalized)
+	return nil
+}
+
+// ClearGatewayURL removes gateway URL of given service version in given environment, so that consumers with
+// gateway access type are given URLs of service instances again. Clearing a gateway URL, that is not set,
+// is not an error.
+func (d Util) ClearGatewayURL(env string, name string, version string) error {
+	key, err := gatewayURLKey(env, name, version)
+	if err != nil {
+		return err
+	}
+
+	if err := d.discoverySource.deleteValue(key); err != nil {
+		d.Logger.Error("Clearing gateway URL %s failed: %s", key, err.Error())
+		return err
+	}
+	d.Logger.Info("Gateway URL cleared, key=%s", key)
+	return nil
+}
+
+// returns key of gateway URL of given service version. Version is normalized in the same way as versions of
+// discovered instances, so that the key matches the one watched by gatewayURLWatches.
+func gatewayURLKey(env string, name string, version string) (string, error) {
+	if env == "" || name == "" {
+		return "", fmt.Errorf("Environment and service name must be set")
+	}
+	v, err := parseInstanceVersion(version)
+	if err != nil {
+		return "", fmt.Errorf("Invalid service version %q: %s", version, err.Error())
+	}
+	return fmt.Sprintf("/environments/%s/services/%s/%s/gatewayUrl", env, name, v.String()), nil
+}
@@ -0,0 +1,279 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// GRPCScheme is the target scheme handled by the gRPC resolver, e.g. kumuluz:///dev/my-service/^1.0.0
+const GRPCScheme = "kumuluz"
+
+// interval in which the gRPC resolver discovers services again, if kumuluzee.discovery.grpc.refresh-interval
+// is not configured
+const defaultGRPCResolverRefreshInterval = 10 * time.Second
+
+// service config pushed to gRPC clients, so that calls are balanced across all resolved instances
+const grpcResolverServiceConfig = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+
+// RegisterGRPCResolver registers a gRPC resolver for the kumuluz:/// scheme, which discovers
+// services using given Util. Should be called before dialing, usually from main or an init function.
+func RegisterGRPCResolver(util Util) {
+	resolver.Register(NewGRPCResolverBuilder(util))
+}
+
+// NewGRPCResolverBuilder returns a gRPC resolver.Builder for the kumuluz:/// scheme, which discovers
+// services using given Util. Use it with grpc.WithResolvers when the builder should not be
+// registered globally.
+//
+// Targets are in the form kumuluz:///<environment>/<name>/<version-range>, where version range is
+// optional. Access type, version selection, fallback environments, Consul datacenters and Consul
+// prepared query can be set with the access, versions, fallback, dc and query parameters, e.g.
+// kumuluz:///staging/my-service/^1.0.0?access=direct&versions=all&fallback=shared. Resolved addresses
+// are balanced using round_robin, unless service config is disabled on the client.
+//
+// Resolver does not watch the registry: targets are discovered again in the interval configured with key
+// kumuluzee.discovery.grpc.refresh-interval (in seconds, default 10), or when the client asks for it, e.g.
+// after a connection failure.
+func NewGRPCResolverBuilder(util Util) resolver.Builder {
+	return &grpcResolverBuilder{
+		util:            util,
+		refreshInterval: loadGRPCResolverRefreshInterval(util),
+	}
+}
+
+type grpcResolverBuilder struct {
+	util            Util
+	refreshInterval time.Duration
+}
+
+// holds state of a single resolved target
+type grpcResolver struct {
+	util            Util
+	options         DiscoverOptions
+	cc              resolver.ClientConn
+	refreshInterval time.Duration
+
+	serviceConfig *serviceconfig.ParseResult // parsed grpcResolverServiceConfig, may be nil
+	addresses     []string                   // last addresses pushed to client connection
+
+	resolveNow chan struct{}
+	done       chan struct{}
+}
+
+func (b *grpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	options, err := parseGRPCTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &grpcResolver{
+		util:            b.util,
+		options:         options,
+		cc:              cc,
+		refreshInterval: b.refreshInterval,
+		resolveNow:      make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+
+	if sc := cc.ParseServiceConfig(grpcResolverServiceConfig); sc.Err == nil {
+		r.serviceConfig = sc
+	} else {
+		b.util.Logger.Warning("Parsing gRPC service config failed: %s", sc.Err.Error())
+	}
+
+	go r.watch()
+
+	return r, nil
+}
+
+func (b *grpcResolverBuilder) Scheme() string {
+	return GRPCScheme
+}
+
+func (r *grpcResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+		// resolving is already pending
+	}
+}
+
+func (r *grpcResolver) Close() {
+	close(r.done)
+}
+
+// resolves target periodically or when asked to, until the resolver is closed
+func (r *grpcResolver) watch() {
+	for {
+		r.resolve()
+
+		select {
+		case <-r.done:
+			return
+		case <-r.resolveNow:
+		case <-time.After(r.refreshInterval):
+		}
+	}
+}
+
+// discovers instances of target service and pushes their addresses to client connection, if they changed
+func (r *grpcResolver) resolve() {
+	addresses, err := r.util.discoverAddresses(r.options)
+	if err != nil {
+		if len(r.addresses) > 0 {
+			// keep using previously resolved addresses
+			r.util.Logger.Warning("gRPC resolving failed for %s, using last known addresses. Error: %s", r.options.Value, err.Error())
+			return
+		}
+		r.util.Logger.Error("gRPC resolving failed for %s: %s", r.options.Value, err.Error())
+		r.cc.ReportError(err)
+		return
+	}
+
+	sort.Strings(addresses)
+	if equalStrings(addresses, r.addresses) {
+		return
+	}
+
+	state := resolver.State{
+		ServiceConfig: r.serviceConfig,
+	}
+	for _, a := range addresses {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: a})
+	}
+
+	if err := r.cc.UpdateState(state); err != nil {
+		r.util.Logger.Warning("gRPC resolver state update failed for %s: %s", r.options.Value, err.Error())
+	}
+	r.addresses = addresses
+}
+
+// returns host:port addresses of all instances matching options, see Util.discoverURLs
+func (d Util) discoverAddresses(options DiscoverOptions) ([]string, error) {
+	urls, err := d.discoverURLs(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, instanceURL := range urls {
+		addr, err := hostPortFromURL(instanceURL)
+		if err != nil {
+			d.Logger.Warning("Ignoring instance URL %s: %s", instanceURL, err.Error())
+			continue
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			addresses = append(addresses, addr)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("No service found (no service with URL)")
+	}
+
+	return addresses, nil
+}
+
+// loads refresh interval of gRPC resolvers from configuration key kumuluzee.discovery.grpc.refresh-interval
+func loadGRPCResolverRefreshInterval(util Util) time.Duration {
+	conf := config.NewUtil(config.Options{
+		ConfigPath: util.configOptions.ConfigPath,
+		LogLevel:   logm.LvlWarning, // bit less logs from config
+	})
+
+	refreshInterval := defaultGRPCResolverRefreshInterval
+	if ri, ok := conf.GetInt("kumuluzee.discovery.grpc.refresh-interval"); ok {
+		if ri > 0 {
+			refreshInterval = time.Duration(ri) * time.Second
+		} else {
+			util.Logger.Warning("Invalid kumuluzee.discovery.grpc.refresh-interval %d, using default of %d seconds",
+				ri, defaultGRPCResolverRefreshInterval/time.Second)
+		}
+	}
+	return refreshInterval
+}
+
+// converts gRPC target to DiscoverOptions
+func parseGRPCTarget(target resolver.Target) (DiscoverOptions, error) {
+	var options DiscoverOptions
+
+	parts := strings.SplitN(strings.Trim(target.Endpoint(), "/"), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return options, fmt.Errorf("Invalid gRPC target %q, expected %s:///<environment>/<name>/<version-range>",
+			target.URL.String(), GRPCScheme)
+	}
+
+	options.Environment = parts[0]
+	options.Value = parts[1]
+	if len(parts) == 3 {
+		options.Version = parts[2]
+	}
+
+	switch access := strings.ToLower(target.URL.Query().Get("access")); access {
+	case "":
+	case AccessTypeDirect, AccessTypeGateway, AccessTypeConnect:
+		options.AccessType = access
+	default:
+		return options, fmt.Errorf("Invalid access type %q in gRPC target", access)
+	}
+
+	switch selection := strings.ToLower(target.URL.Query().Get("versions")); selection {
+	case "":
+	case VersionSelectionLatest, VersionSelectionAll:
+		options.VersionSelection = selection
+	default:
+		return options, fmt.Errorf("Invalid version selection %q in gRPC target", selection)
+	}
+
+	if fallback := target.URL.Query().Get("fallback"); fallback != "" {
+		options.FallbackEnvironments = strings.Split(fallback, ",")
+	}
+	if dc := target.URL.Query().Get("dc"); dc != "" {
+		options.Datacenters = strings.Split(dc, ",")
+	}
+	options.PreparedQuery = target.URL.Query().Get("query")
+
+	return options, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func TestParseGRPCTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    DiscoverOptions
+		wantErr bool
+	}{
+		{
+			target: "kumuluz:///dev/orders",
+			want:   DiscoverOptions{Environment: "dev", Value: "orders"},
+		},
+		{
+			target: "kumuluz:///dev/orders/^1.0.0",
+			want:   DiscoverOptions{Environment: "dev", Value: "orders", Version: "^1.0.0"},
+		},
+		{
+			target: "kumuluz:///staging/orders/1.x?access=GATEWAY&versions=all",
+			want: DiscoverOptions{Environment: "staging", Value: "orders", Version: "1.x",
+				AccessType: AccessTypeGateway, VersionSelection: VersionSelectionAll},
+		},
+		{
+			target: "kumuluz:///dev/orders?access=connect&versions=latest",
+			want: DiscoverOptions{Environment: "dev", Value: "orders",
+				AccessType: AccessTypeConnect, VersionSelection: VersionSelectionLatest},
+		},
+		{
+			target: "kumuluz:///staging/orders?fallback=shared,dev&dc=dc1,*&query=orders-query",
+			want: DiscoverOptions{Environment: "staging", Value: "orders",
+				FallbackEnvironments: []string{"shared", "dev"}, Datacenters: []string{"dc1", "*"},
+				PreparedQuery: "orders-query"},
+		},
+		{target: "kumuluz:///", wantErr: true},
+		{target: "kumuluz:///dev", wantErr: true},
+		{target: "kumuluz:///dev/", wantErr: true},
+		{target: "kumuluz:////orders", wantErr: true},
+		{target: "kumuluz:///dev/orders?access=proxy", wantErr: true},
+		{target: "kumuluz:///dev/orders?versions=weighted", wantErr: true},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatalf("parsing target %q failed: %s", test.target, err.Error())
+		}
+
+		options, err := parseGRPCTarget(resolver.Target{URL: *u})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseGRPCTarget(%q) = %+v, want error", test.target, options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGRPCTarget(%q) failed: %s", test.target, err.Error())
+		} else if !reflect.DeepEqual(options, test.want) {
+			t.Errorf("parseGRPCTarget(%q) = %+v, want %+v", test.target, options, test.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mc0239/logm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// LockHandle is returned by Util.Lock when the lock is acquired. The lock is renewed in the background
+// until it is released. LockHandle is safe for concurrent use.
+type LockHandle interface {
+	// IsHeld returns true while the lock is still held.
+	IsHeld() bool
+	// Renew extends TTL of the lock immediately. Returns error if the lock is not held anymore.
+	Renew() error
+	// Release releases the lock and stops renewing it.
+	Release() error
+	// Lost returns a channel, which is closed when the lock is not held anymore, either because it
+	// could not be renewed in time or because of Release.
+	Lost() <-chan struct{}
+}
+
+type lockHandle struct {
+	lock *heldLock
+}
+
+func (l *lockHandle) IsHeld() bool {
+	return l.lock.isHeld()
+}
+
+func (l *lockHandle) Renew() error {
+	return l.lock.renew()
+}
+
+func (l *lockHandle) Release() error {
+	return l.lock.release()
+}
+
+func (l *lockHandle) Lost() <-chan struct{} {
+	return l.lock.lost
+}
+
+// Lock blocks until the lock with given name is acquired, or until ctx is done. Locks are shared by
+// instances of the same service and environment, configured with keys kumuluzee.name and
+// kumuluzee.env.name or taken from the service registered with this Util, and stored under
+// /environments/<env>/services/<name>/locks/<lockName>. The lock expires if it is not renewed within ttl.
+// If ttl is 0, TTL of the service (configuration key kumuluzee.discovery.ttl) is used. Note that Consul
+// does not support TTLs shorter than 10 seconds and etcd rounds TTLs up to whole seconds.
+func (d Util) Lock(ctx context.Context, lockName string, ttl time.Duration) (LockHandle, error) {
+	regconf, err := d.lockServiceConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(regconf.Discovery.TTL) * time.Second
+	}
+
+	holderID, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("/environments/%s/services/%s/locks/%s", regconf.Env.Name, regconf.Name, lockName)
+
+	d.Logger.Verbose("Acquiring lock %s as %s", key, holderID.String())
+	lock, err := acquireLock(ctx, d.discoverySource.newLock(key, holderID.String(), ttl), ttl, &d.Logger)
+	if err != nil {
+		return nil, err
+	}
+	d.Logger.Verbose("Acquired lock %s", key)
+
+	return &lockHandle{lock: lock}, nil
+}
+
+// returned by distributedLock.renew when the lock is not held anymore
+var errLockLost = errors.New("lock is not held anymore")
+
+// distributedLock is a lock held in the key-value store of a discovery source. The lock expires
+// if it is not renewed within its TTL, so that a crashed holder does not keep it forever.
+// Implementations are not safe for concurrent use.
+type distributedLock interface {
+	// tries to acquire the lock once. Returns false if the lock is held by someone else.
+	tryAcquire() (bool, error)
+	// extends TTL of the held lock. Returns errLockLost if the lock is not held anymore.
+	renew() error
+	// releases the held lock
+	release() error
+}
+
+// holds an acquired distributedLock and keeps renewing it until it is released or lost.
+// Safe for concurrent use.
+type heldLock struct {
+	lock distributedLock
+	ttl  time.Duration
+
+	mutex sync.Mutex // guards lock and held
+	held  bool
+
+	lost     chan struct{} // closed when the lock is released or lost
+	lostOnce sync.Once
+	stop     chan struct{} // closed on release
+	done     chan struct{} // closed when renewing stops
+
+	logger *logm.Logm
+}
+
+// blocks until the lock is acquired or ctx is done. Acquiring is retried every ttl/3.
+func acquireLock(ctx context.Context, lock distributedLock, ttl time.Duration, logger *logm.Logm) (*heldLock, error) {
+	interval := ttl / 3
+
+	for {
+		acquired, err := lock.tryAcquire()
+		if err != nil {
+			logger.Warning("Acquiring lock failed: %s", err.Error())
+		} else if acquired {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+
+	h := &heldLock{
+		lock:   lock,
+		ttl:    ttl,
+		held:   true,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go h.keepRenewed(interval)
+
+	return h, nil
+}
+
+// renews the lock every interval. If the lock cannot be renewed within its TTL, it is considered lost.
+func (h *heldLock) keepRenewed(interval time.Duration) {
+	defer close(h.done)
+
+	lastRenewed := time.Now()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(interval):
+		}
+
+		h.mutex.Lock()
+		err := h.lock.renew()
+		h.mutex.Unlock()
+
+		if err == nil {
+			lastRenewed = time.Now()
+			continue
+		}
+
+		h.logger.Warning("Renewing lock failed: %s", err.Error())
+		if err == errLockLost || time.Since(lastRenewed) >= h.ttl {
+			h.mutex.Lock()
+			h.held = false
+			h.mutex.Unlock()
+			h.lostOnce.Do(func() { close(h.lost) })
+			return
+		}
+	}
+}
+
+// renews the lock immediately
+func (h *heldLock) renew() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.held {
+		return errLockLost
+	}
+	err := h.lock.renew()
+	if err == errLockLost {
+		h.held = false
+		h.lostOnce.Do(func() { close(h.lost) })
+	}
+	return err
+}
+
+func (h *heldLock) isHeld() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.held
+}
+
+// stops renewing and releases the lock, if it is still held
+func (h *heldLock) release() error {
+	h.mutex.Lock()
+	select {
+	case <-h.stop:
+		// already released
+		h.mutex.Unlock()
+		return nil
+	default:
+		close(h.stop)
+	}
+	h.mutex.Unlock()
+
+	<-h.done
+
+	h.mutex.Lock()
+	var err error
+	if h.held {
+		err = h.lock.release()
+		h.held = false
+	}
+	h.mutex.Unlock()
+
+	h.lostOnce.Do(func() { close(h.lost) })
+	return err
+}
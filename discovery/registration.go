@@ -0,0 +1,265 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mc0239/logm"
+)
+
+// holds configuration and state of a registered service instance. Registration itself is performed
+// by the discovery source, through register, ttlUpdate and deregister functions.
+type serviceInstance struct {
+	reregistrations int64 // accessed atomically, first field to keep 64-bit alignment
+
+	id      string
+	options *registerConfiguration // loaded as config bundle
+
+	// performs registration, returns true on success
+	register func() bool
+	// performs TTL update, returns ok=true on success and expired=true if registration does not exist anymore
+	ttlUpdate func() (ok bool, expired bool)
+	// removes registration from the registry
+	deregister func() error
+	// if true, TTL is updated immediately after registration instead of after ping interval
+	ttlUpdateAfterRegister bool
+
+	// held while the instance is registered, if service is registered with RegisterOptions.Singleton
+	singletonLock distributedLock
+
+	isRegistered       bool      // only accessed from the run loop
+	hasBeenRegistered  bool      // only accessed from the run loop
+	holdsSingletonLock bool      // only accessed from the run loop
+	singletonRenewed   time.Time // last successful renewal of singleton lock, only accessed from the run loop
+	isStandby          bool      // only accessed from the run loop
+
+	stop chan struct{} // closed on deregistration
+	done chan struct{} // closed when run loop exits
+}
+
+// holds service instances registered by a discovery source. Safe for concurrent use.
+type serviceInstances struct {
+	mutex     sync.Mutex
+	instances map[string]*serviceInstance // registered service instances by id
+}
+
+// returns key of the lock, which ensures that only one instance of a singleton service is registered
+func singletonLockKey(regconf *registerConfiguration) string {
+	return fmt.Sprintf("/environments/%s/services/%s/%s/singleton", regconf.Env.Name, regconf.Name, regconf.Version)
+}
+
+// adds service instance and starts keeping it registered
+func (s *serviceInstances) start(inst *serviceInstance, backoffPolicy BackoffPolicy, logger *logm.Logm) {
+	inst.stop = make(chan struct{})
+	inst.done = make(chan struct{})
+
+	s.mutex.Lock()
+	if s.instances == nil {
+		s.instances = make(map[string]*serviceInstance)
+	}
+	s.instances[inst.id] = inst
+	s.mutex.Unlock()
+
+	go inst.run(backoffPolicy, logger)
+}
+
+// stops heartbeats of service instance with given id and removes it from the registry
+func (s *serviceInstances) deregister(serviceID string, logger *logm.Logm) error {
+	s.mutex.Lock()
+	inst, ok := s.instances[serviceID]
+	delete(s.instances, serviceID)
+	s.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Service with id %s is not registered", serviceID)
+	}
+
+	// stop heartbeats before deregistering, so the instance does not get registered again
+	close(inst.stop)
+	<-inst.done
+
+	// run loop has exited, so registration state can be read. Instances, that were never registered (e.g.
+	// singleton standbys), have nothing to deregister.
+	var err error
+	if inst.isRegistered {
+		logger.Info("Service deregistration, id=%s", inst.id)
+		err = inst.deregister()
+	} else if inst.hasBeenRegistered {
+		// registration may still exist after a failed TTL update, but it may also be gone already
+		if dErr := inst.deregister(); dErr != nil {
+			logger.Verbose("Deregistration of service %s, which is not registered anymore, failed: %s", inst.id, dErr.Error())
+		}
+	}
+
+	// release singleton lock only after deregistration, so that a standby instance can take over
+	if inst.holdsSingletonLock {
+		if lockErr := inst.singletonLock.release(); lockErr != nil {
+			logger.Warning("Releasing singleton lock of service %s failed: %s", inst.id, lockErr.Error())
+		}
+	}
+
+	return err
+}
+
+func (s *serviceInstances) ids() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ids []string
+	for id := range s.instances {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// returns configuration of registered service instance with given id
+func (s *serviceInstances) configuration(serviceID string) (registerConfiguration, bool) {
+	s.mutex.Lock()
+	inst, ok := s.instances[serviceID]
+	s.mutex.Unlock()
+
+	if !ok {
+		return registerConfiguration{}, false
+	}
+	return *inst.options, true
+}
+
+func (s *serviceInstances) reregistrations(serviceID string) int64 {
+	s.mutex.Lock()
+	inst, ok := s.instances[serviceID]
+	s.mutex.Unlock()
+
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(&inst.reregistrations)
+}
+
+// if service is not registered, performs registration. Otherwise perform ttl update.
+// Repeats until service instance is deregistered or retry attempts are exhausted.
+func (inst *serviceInstance) run(backoffPolicy BackoffPolicy, logger *logm.Logm) {
+	defer close(inst.done)
+
+	retry := retryState{policy: backoffPolicy}
+	for {
+		ok, registered := inst.heartbeat(logger)
+
+		var sleep time.Duration
+		if !ok {
+			// Something went wrong with either registration or TTL update :(
+
+			var retryOk bool
+			sleep, retryOk = retry.next()
+			if !retryOk {
+				logger.Error("Giving up registration of service %s, retry attempts exhausted", inst.id)
+				return
+			}
+			logger.Verbose("Retrying registration of service %s in %d ms", inst.id, sleep/time.Millisecond)
+		} else {
+			// Everything is alright, either registration or TTL update was successful :)
+
+			if !registered || !inst.ttlUpdateAfterRegister {
+				sleep = time.Duration(inst.options.Discovery.PingInterval) * time.Second
+			}
+			retry.reset()
+		}
+
+		select {
+		case <-inst.stop:
+			return
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// performs a single registration or TTL update. Returns ok=false if it failed and registered=true if
+// service was registered in this heartbeat. Singleton services that wait for another instance to
+// deregister return ok=true, registered=false.
+func (inst *serviceInstance) heartbeat(logger *logm.Logm) (ok bool, registered bool) {
+	if inst.singletonLock != nil {
+		if !inst.holdsSingletonLock {
+			acquired, err := inst.singletonLock.tryAcquire()
+			if err != nil {
+				logger.Error("Acquiring singleton lock for service %s failed: %s", inst.id, err.Error())
+				return false, false
+			}
+			if !acquired {
+				if !inst.isStandby {
+					logger.Info("Service of this kind is already registered, service %s is standing by", inst.id)
+					inst.isStandby = true
+				}
+				return true, false
+			}
+			logger.Info("Acquired singleton lock for service %s", inst.id)
+			inst.holdsSingletonLock = true
+			inst.singletonRenewed = time.Now()
+			inst.isStandby = false
+		} else if err := inst.singletonLock.renew(); err == nil {
+			inst.singletonRenewed = time.Now()
+		} else if err != errLockLost &&
+			time.Since(inst.singletonRenewed) < time.Duration(inst.options.Discovery.TTL)*time.Second {
+			// the lock may still be held, try renewing it again on the next heartbeat
+			logger.Warning("Renewing singleton lock for service %s failed: %s", inst.id, err.Error())
+		} else {
+			logger.Warning("Singleton lock for service %s lost: %s", inst.id, err.Error())
+			inst.holdsSingletonLock = false
+			if inst.isRegistered {
+				// another instance may take over, do not stay registered alongside it
+				if err := inst.deregister(); err != nil {
+					logger.Warning("Deregistration of service %s failed: %s", inst.id, err.Error())
+				}
+				inst.isRegistered = false
+			}
+			return false, false
+		}
+	}
+
+	if !inst.isRegistered {
+		ok = inst.register()
+	} else {
+		var expired bool
+		ok, expired = inst.ttlUpdate()
+		if !ok {
+			inst.isRegistered = false
+		}
+		if expired {
+			// registration is gone, re-create it in the same cycle
+			logger.Warning("Registration of service %s expired, registering again", inst.id)
+			ok = inst.register()
+		}
+	}
+
+	if ok && !inst.isRegistered {
+		if inst.hasBeenRegistered {
+			atomic.AddInt64(&inst.reregistrations, 1)
+		}
+		inst.isRegistered = true
+		inst.hasBeenRegistered = true
+		return true, true
+	}
+
+	return ok, false
+}
@@ -0,0 +1,104 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// lock, whose renewals fail with given error
+type failingRenewLock struct {
+	distributedLock
+	err error
+}
+
+func (l *failingRenewLock) renew() error {
+	if l.err != nil {
+		return l.err
+	}
+	return l.distributedLock.renew()
+}
+
+func TestDeregisterStandby(t *testing.T) {
+	logger := testLogger()
+	registry := newFakeRegistry()
+	backoff := ExponentialBackoff{InitialDelay: time.Millisecond}
+
+	var instances serviceInstances
+	instances.start(registry.serviceInstance("a", "1.0.0", registry.newLock("singleton", "a")), backoff, logger)
+	for i := 0; i < 100 && !registry.isRegistered("a"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !registry.isRegistered("a") {
+		t.Fatal("singleton instance was not registered")
+	}
+
+	standby := registry.serviceInstance("b", "1.0.0", registry.newLock("singleton", "b"))
+	standby.deregister = func() error {
+		return errors.New("service b is not registered")
+	}
+	instances.start(standby, backoff, logger)
+	time.Sleep(10 * time.Millisecond)
+
+	if err := instances.deregister("b", logger); err != nil {
+		t.Errorf("deregistering standby failed: %s", err.Error())
+	}
+	if err := instances.deregister("a", logger); err != nil {
+		t.Errorf("deregistering registered instance failed: %s", err.Error())
+	}
+}
+
+func TestSingletonLockRenewErrors(t *testing.T) {
+	logger := testLogger()
+	registry := newFakeRegistry()
+	lock := &failingRenewLock{distributedLock: registry.newLock("singleton", "a")}
+
+	inst := registry.serviceInstance("a", "1.0.0", lock)
+	inst.options.Discovery.TTL = 30
+	if ok, _ := inst.heartbeat(logger); !ok || !inst.isRegistered {
+		t.Fatal("singleton instance was not registered")
+	}
+
+	// transient error within TTL keeps the instance registered
+	lock.err = errors.New("timeout")
+	if ok, _ := inst.heartbeat(logger); !ok || !inst.isRegistered || !inst.holdsSingletonLock {
+		t.Error("instance was deregistered after a transient renew error")
+	}
+
+	// errors for longer than TTL lose the lock
+	inst.singletonRenewed = time.Now().Add(-time.Minute)
+	if ok, _ := inst.heartbeat(logger); ok || inst.isRegistered || inst.holdsSingletonLock {
+		t.Error("instance stayed registered after renewals failed for longer than TTL")
+	}
+
+	// lost lock deregisters immediately
+	lock.err = nil
+	if ok, _ := inst.heartbeat(logger); !ok || !inst.isRegistered {
+		t.Fatal("singleton instance was not registered again")
+	}
+	lock.err = errLockLost
+	if ok, _ := inst.heartbeat(logger); ok || inst.isRegistered {
+		t.Error("instance stayed registered after the lock was lost")
+	}
+}
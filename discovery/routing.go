@@ -0,0 +1,149 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+)
+
+// routing rules of a service, stored as JSON in key /environments/<env>/services/<name>/routingRules
+type routingRules struct {
+	// relative weights of version ranges, applied as with VersionSelectionWeighted
+	Weights []routingWeight `json:"weights"`
+	// header-based overrides, evaluated in order before weights
+	Overrides []routingOverride `json:"overrides"`
+}
+
+type routingWeight struct {
+	Version string `json:"version"`
+	Weight  int    `json:"weight"`
+}
+
+// routes requests with a matching header to instances with version in range of Version. If Value is
+// empty, presence of the header is enough.
+type routingOverride struct {
+	Header  string `json:"header"`
+	Value   string `json:"value"`
+	Version string `json:"version"`
+}
+
+// holds routing rules of discovered services. Safe for concurrent use.
+type routingRulesWatches struct {
+	watches watchedKeys
+}
+
+// returns current routing rules of given service and creates a watch for them, if not already made.
+// Returns nil if rules are not set.
+func (r *routingRulesWatches) get(configOptions config.Options, options DiscoverOptions, logger *logm.Logm) *routingRules {
+	watcherNamespace := fmt.Sprintf("/environments/%s/services/%s", options.Environment, options.Value)
+
+	return r.watches.get(configOptions, watcherNamespace, "routingRules", func(value string) interface{} {
+		return parseRoutingRules(value, watcherNamespace, logger)
+	}, logger).(*routingRules)
+}
+
+// parses routing rules JSON. Returns nil if value is empty or invalid, in which case no rules are applied.
+func parseRoutingRules(value string, watcherNamespace string, logger *logm.Logm) *routingRules {
+	if value == "" {
+		return nil
+	}
+
+	var rules routingRules
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		logger.Warning("Ignoring invalid routingRules for %s: %s", watcherNamespace, err.Error())
+		return nil
+	}
+	for _, w := range rules.Weights {
+		if _, err := parseVersion(w.Version); err != nil {
+			logger.Warning("Ignoring invalid routingRules for %s: %s", watcherNamespace, err.Error())
+			return nil
+		}
+	}
+	for _, o := range rules.Overrides {
+		if _, err := parseVersion(o.Version); err != nil || o.Header == "" {
+			logger.Warning("Ignoring invalid routingRules for %s: override must have a header and a valid version", watcherNamespace)
+			return nil
+		}
+	}
+
+	return &rules
+}
+
+// returns options with version selection set according to routing rules. The first override matching
+// options.Headers, that has instances in range, is applied. Otherwise weights are applied, unless
+// options.VersionWeights are already set or none of the weighted versions has instances in range of
+// options.Version, in which case options are returned unchanged.
+func (r *routingRules) apply(discoveredInstances []discoveredService, options DiscoverOptions) DiscoverOptions {
+	if r == nil {
+		return options
+	}
+
+	for _, o := range r.Overrides {
+		if !o.matches(options.Headers) {
+			continue
+		}
+
+		overridden := options
+		overridden.VersionSelection = VersionSelectionWeighted
+		overridden.VersionWeights = []VersionWeight{{Version: o.Version, Weight: 1}}
+		if instances, err := selectServiceInstances(discoveredInstances, overridden); err == nil && len(instances) > 0 {
+			return overridden
+		}
+	}
+
+	if len(r.Weights) > 0 && len(options.VersionWeights) == 0 {
+		weighted := options
+		weighted.VersionSelection = VersionSelectionWeighted
+		for _, w := range r.Weights {
+			weighted.VersionWeights = append(weighted.VersionWeights, VersionWeight{
+				Version: w.Version,
+				Weight:  w.Weight,
+			})
+		}
+		if instances, err := selectServiceInstances(discoveredInstances, weighted); err == nil && len(instances) > 0 {
+			return weighted
+		}
+	}
+
+	return options
+}
+
+func (o routingOverride) matches(headers http.Header) bool {
+	values, ok := headers[http.CanonicalHeaderKey(o.Header)]
+	if !ok {
+		return false
+	}
+	if o.Value == "" {
+		return true
+	}
+	for _, v := range values {
+		if v == o.Value {
+			return true
+		}
+	}
+	return false
+}
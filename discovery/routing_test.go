@@ -0,0 +1,94 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRoutingRulesApply(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.add("a", "1.2.0", "http://10.0.0.1:8080")
+	registry.add("b", "1.3.0", "http://10.0.0.2:8080")
+	registry.add("c", "2.0.0", "http://10.0.0.3:8080")
+	instances, _ := registry.discoverInstances(DiscoverOptions{})
+
+	rules := &routingRules{
+		Weights:   []routingWeight{{Version: "1.2.x", Weight: 1}},
+		Overrides: []routingOverride{{Header: "X-Canary", Value: "true", Version: "1.3.0"}},
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		headers http.Header
+		want    string
+	}{
+		{"weights", "^1.0.0", nil, "a"},
+		{"override", "^1.0.0", http.Header{"X-Canary": {"true"}}, "b"},
+		{"override value does not match", "^1.0.0", http.Header{"X-Canary": {"false"}}, "a"},
+		{"weights outside of version range", "^2.0.0", nil, "c"},
+		{"override outside of version range", "^2.0.0", http.Header{"X-Canary": {"true"}}, "c"},
+	}
+
+	for _, test := range tests {
+		options := DiscoverOptions{Value: "orders", Version: test.version, Headers: test.headers}
+		fillDefaultDiscoverOptions(&options)
+
+		result, err := selectServiceInstances(instances, rules.apply(instances, options))
+		if err != nil {
+			t.Errorf("%s: selecting instances failed: %s", test.name, err.Error())
+			continue
+		}
+		if len(result) != 1 || result[0].id != test.want {
+			t.Errorf("%s: selected %v, want instance %s", test.name, result, test.want)
+		}
+	}
+}
+
+func TestWeightedVersionSelection(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.add("a", "1.2.0", "http://10.0.0.1:8080")
+	registry.add("b", "1.3.0", "http://10.0.0.2:8080")
+	registry.add("c", "1.4.0", "http://10.0.0.3:8080")
+	instances, _ := registry.discoverInstances(DiscoverOptions{})
+
+	options := DiscoverOptions{Value: "orders", Version: "^1.0.0", VersionSelection: VersionSelectionWeighted}
+	fillDefaultDiscoverOptions(&options)
+	if result, err := selectServiceInstances(instances, options); err != errNoVersionWeights {
+		t.Errorf("selecting instances without version weights = %v, %v, want %s", result, err, errNoVersionWeights)
+	}
+
+	weights := []VersionWeight{{Version: "1.2.x", Weight: 1}, {Version: "1.3.x", Weight: 2}, {Version: "1.4.x", Weight: 0}}
+	result, err := extractServicesInWeightedRanges(instances, weights)
+	if err != nil {
+		t.Fatalf("extracting instances in weighted ranges failed: %s", err.Error())
+	}
+	extracted := make(map[string]bool)
+	for _, instance := range result {
+		extracted[instance.id] = true
+	}
+	if len(result) != 2 || !extracted["a"] || !extracted["b"] {
+		t.Errorf("extracted %v, want instances a and b", result)
+	}
+}
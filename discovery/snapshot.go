@@ -0,0 +1,134 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kumuluz/kumuluzee-go-config/config"
+	"github.com/mc0239/logm"
+)
+
+// format of the discovery snapshot file
+type discoverySnapshot struct {
+	Services []snapshotService `json:"services"`
+}
+
+type snapshotService struct {
+	Environment           string    `json:"environment"`
+	Name                  string    `json:"name"`
+	Version               string    `json:"version"`
+	AccessType            string    `json:"accessType"`
+	URL                   string    `json:"url"`
+	DiscoveredEnvironment string    `json:"discoveredEnvironment,omitempty"`
+	Datacenter            string    `json:"datacenter,omitempty"`
+	Discovered            time.Time `json:"discovered"`
+}
+
+// interval of persisting discovery snapshot, if kumuluzee.discovery.snapshot.persist-interval is not configured
+const defaultSnapshotPersistInterval = 30 * time.Second
+
+// if kumuluzee.discovery.snapshot.path is configured, loads last known services from the snapshot file
+// and starts persisting them periodically, so they are available after restart even if the registry
+// is not reachable
+func startDiscoverySnapshots(conf config.Util, lastKnown *lastKnownServices, logger *logm.Logm) {
+	snapshotPath, ok := conf.GetString("kumuluzee.discovery.snapshot.path")
+	if !ok || snapshotPath == "" {
+		return
+	}
+
+	persistInterval := defaultSnapshotPersistInterval
+	if pi, ok := conf.GetInt("kumuluzee.discovery.snapshot.persist-interval"); ok {
+		if pi > 0 {
+			persistInterval = time.Duration(pi) * time.Second
+		} else {
+			logger.Warning("Invalid kumuluzee.discovery.snapshot.persist-interval %d, using default of %d seconds",
+				pi, defaultSnapshotPersistInterval/time.Second)
+		}
+	}
+
+	if err := loadDiscoverySnapshot(snapshotPath, lastKnown); err == nil {
+		logger.Info("Loaded discovery snapshot from %s", snapshotPath)
+	} else if !os.IsNotExist(err) {
+		logger.Warning("Loading discovery snapshot from %s failed: %s", snapshotPath, err.Error())
+	}
+
+	go func() {
+		var lastSaved time.Time
+		for range time.Tick(persistInterval) {
+			modified := lastKnown.lastModified()
+			if !modified.After(lastSaved) {
+				continue // nothing new to persist
+			}
+			if err := saveDiscoverySnapshot(snapshotPath, lastKnown); err != nil {
+				logger.Warning("Persisting discovery snapshot to %s failed: %s", snapshotPath, err.Error())
+				continue
+			}
+			lastSaved = modified
+		}
+	}()
+}
+
+func loadDiscoverySnapshot(snapshotPath string, lastKnown *lastKnownServices) error {
+	data, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	var snapshot discoverySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	lastKnown.restore(snapshot.Services)
+	return nil
+}
+
+// writes snapshot to a temporary file first, so that a crash while persisting does not corrupt the snapshot
+func saveDiscoverySnapshot(snapshotPath string, lastKnown *lastKnownServices) error {
+	data, err := json.Marshal(discoverySnapshot{
+		Services: lastKnown.snapshot(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(snapshotPath), filepath.Base(snapshotPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), snapshotPath)
+}
@@ -0,0 +1,150 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// default ports of URL schemes, omitted from normalized URLs
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// returns normalized URL of service with given protocol, address, port and base path. IPv6 addresses are
+// enclosed in brackets.
+// Base path is escaped, as returned by basePathFromURL.
+func buildServiceURL(protocol string, addr string, port int, basePath string) string {
+	u := url.URL{
+		Scheme: strings.ToLower(protocol),
+		Host:   joinHostPort(protocol, addr, strconv.Itoa(port)),
+	}
+	setEscapedPath(&u, strings.TrimSuffix(basePath, "/"))
+	return u.String()
+}
+
+// validates service URL and returns it normalized: scheme and host are lower case, IPv6 addresses are enclosed
+// in brackets, default port of the scheme and trailing slash are removed. URL must be absolute, with http or
+// https scheme and a host, and may not contain query or fragment. Escaping of the path is kept, e.g. /a%2Fb/
+// is normalized to /a%2Fb.
+func normalizeServiceURL(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[scheme]; !ok {
+		return "", fmt.Errorf("URL %q must use http or https scheme", rawURL)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("URL %q has no host", rawURL)
+	}
+	if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+		return "", fmt.Errorf("IPv6 address in URL %q must be enclosed in brackets", rawURL)
+	}
+	if port := u.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return "", fmt.Errorf("URL %q has invalid port", rawURL)
+		}
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("URL %q may not contain user info, query or fragment", rawURL)
+	}
+
+	normalized := url.URL{
+		Scheme: scheme,
+		Host:   joinHostPort(scheme, u.Hostname(), u.Port()),
+	}
+	setEscapedPath(&normalized, strings.TrimSuffix(u.EscapedPath(), "/"))
+	return normalized.String(), nil
+}
+
+// returns host:port part of given URL, using default port of URL scheme if port is not set
+func hostPortFromURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("URL %q has no host", rawURL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		if port = defaultPorts[strings.ToLower(u.Scheme)]; port == "" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// returns escaped path of base URL without trailing slash, e.g. /api for http://localhost:8080/api/
+func basePathFromURL(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.EscapedPath(), "/")
+}
+
+// sets path of URL from its escaped form, so that escaped characters like %2F are kept
+func setEscapedPath(u *url.URL, escapedPath string) {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		u.Path = escapedPath
+		return
+	}
+	u.Path = path
+	u.RawPath = escapedPath
+}
+
+// validates host of a service, which may be an IP address (IPv6 optionally in brackets) or a host name, and
+// returns it without brackets
+func normalizeServiceHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	if host == "" || strings.ContainsAny(host, ":/?#[]@ ") {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	return strings.ToLower(host), nil
+}
+
+// returns host and port joined for use in URL with given scheme. Port is omitted if it is the default
+// port of the scheme.
+func joinHostPort(scheme string, host string, port string) string {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if port == "" || defaultPorts[strings.ToLower(scheme)] == port {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,371 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blang/semver"
+)
+
+var (
+	// matches hyphen ranges, e.g. "1.2.3 - 2.3.4"
+	hyphenRangeRegexp = regexp.MustCompile(`^(\S+)\s+-\s+(\S+)$`)
+	// matches whitespace between an operator and a version, e.g. ">= 1.2.3"
+	operatorSpaceRegexp = regexp.MustCompile(`(~>|<=|>=|!=|[<>=~^!])\s+`)
+	// splits a comparator into an operator and a (partial) version
+	comparatorRegexp = regexp.MustCompile(`^(~>|<=|>=|!=|<|>|=|~|\^|!)?(.*)$`)
+)
+
+// maximum number of entries in each of the parsing caches. When full, a cache is cleared.
+const versionCacheSize = 1024
+
+// caches of parsed version ranges and instance versions, since the same few are parsed on every discovery
+var (
+	versionRangeCache    parsedVersionCache
+	instanceVersionCache parsedVersionCache
+)
+
+// holds results of parsing by input string. Safe for concurrent use.
+type parsedVersionCache struct {
+	mutex   sync.RWMutex
+	results map[string]parsedVersion
+}
+
+type parsedVersion struct {
+	versionRange semver.Range
+	version      semver.Version
+	err          error
+}
+
+func (c *parsedVersionCache) get(s string, parse func(s string) parsedVersion) parsedVersion {
+	c.mutex.RLock()
+	result, ok := c.results[s]
+	c.mutex.RUnlock()
+	if ok {
+		return result
+	}
+
+	result = parse(s)
+
+	c.mutex.Lock()
+	if c.results == nil || len(c.results) >= versionCacheSize {
+		c.results = make(map[string]parsedVersion)
+	}
+	c.results[s] = result
+	c.mutex.Unlock()
+
+	return result
+}
+
+// a single comparison against a version. Comparator with empty op matches any version.
+type versionComparator struct {
+	op      string
+	version semver.Version
+}
+
+// comparators, that all have to match
+type comparatorSet []versionComparator
+
+// version, where major, minor or patch may be missing or replaced with x, X or *
+type partialVersion struct {
+	major, minor, patch uint64
+	parts               int // number of given numeric parts, 0 to 3
+	pre                 []semver.PRVersion
+}
+
+// parses an NPM-like version range, see parseVersionRange. Parsed ranges are cached.
+func parseVersion(version string) (semver.Range, error) {
+	result := versionRangeCache.get(version, func(s string) parsedVersion {
+		r, err := parseVersionRange(s)
+		return parsedVersion{versionRange: r, err: err}
+	})
+	return result.versionRange, result.err
+}
+
+// parses version of a discovered instance, which may be in a tolerant form, e.g. "v1.2". Parsed versions
+// are cached.
+func parseInstanceVersion(version string) (semver.Version, error) {
+	result := instanceVersionCache.get(version, func(s string) parsedVersion {
+		v, err := semver.ParseTolerant(s)
+		return parsedVersion{version: v, err: err}
+	})
+	return result.version, result.err
+}
+
+// parses an NPM-like version range. Supported are primitive comparators (<, <=, >, >=, =, !=),
+// x-ranges (1.2.x, 1.*, 1.2), tilde (~1.2.3) and caret (^0.2.3) ranges, hyphen ranges (1.2 - 1.4) and
+// unions of ranges joined with ||. As with NPM, versions with a pre-release tag only match the range, if
+// one of the comparators of the matching set has a pre-release tag on the same major.minor.patch tuple.
+func parseVersionRange(version string) (semver.Range, error) {
+	var sets []comparatorSet
+	for _, setString := range strings.Split(version, "||") {
+		set, err := parseComparatorSet(strings.TrimSpace(setString))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version range %q: %s", version, err.Error())
+		}
+		sets = append(sets, set)
+	}
+
+	return func(v semver.Version) bool {
+		for _, set := range sets {
+			if set.matches(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func parseComparatorSet(set string) (comparatorSet, error) {
+	if m := hyphenRangeRegexp.FindStringSubmatch(set); m != nil {
+		from, err := parsePartialVersion(m[1])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePartialVersion(m[2])
+		if err != nil {
+			return nil, err
+		}
+
+		lower, _ := desugarComparator(">=", from)
+		upper, _ := desugarComparator("<=", to)
+		return append(lower, upper...), nil
+	}
+
+	var comparators comparatorSet
+	for _, c := range strings.Fields(operatorSpaceRegexp.ReplaceAllString(set, "$1")) {
+		m := comparatorRegexp.FindStringSubmatch(c)
+		op := m[1]
+		if op == "!" {
+			op = "!="
+		} else if op == "~>" {
+			op = "~"
+		}
+
+		v, err := parsePartialVersion(m[2])
+		if err != nil {
+			return nil, err
+		}
+		desugared, err := desugarComparator(op, v)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, desugared...)
+	}
+
+	if len(comparators) == 0 {
+		// empty range matches any version
+		comparators = append(comparators, versionComparator{})
+	}
+	return comparators, nil
+}
+
+func parsePartialVersion(s string) (partialVersion, error) {
+	var v partialVersion
+	s = strings.TrimLeft(s, "vV=")
+
+	// build metadata is ignored
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	var pre string
+	if i := strings.Index(s, "-"); i >= 0 {
+		s, pre = s[:i], s[i+1:]
+	}
+
+	if s == "" {
+		return v, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	numbers := []*uint64{&v.major, &v.minor, &v.patch}
+	wildcard := false
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			wildcard = true
+			continue
+		}
+		if wildcard {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+		v.parts++
+	}
+
+	if pre != "" {
+		if v.parts < 3 {
+			return v, fmt.Errorf("pre-release tag in partial version %q", s)
+		}
+		for _, p := range strings.Split(pre, ".") {
+			prv, err := semver.NewPRVersion(p)
+			if err != nil {
+				return v, err
+			}
+			v.pre = append(v.pre, prv)
+		}
+	}
+
+	return v, nil
+}
+
+// converts operator and partial version to primitive comparators
+func desugarComparator(op string, v partialVersion) (comparatorSet, error) {
+	anyVersion := comparatorSet{{}}
+	noVersion := comparatorSet{{op: "<", version: zeroPreVersion(semver.Version{})}}
+
+	switch op {
+	case "", "=":
+		if v.parts == 0 {
+			return anyVersion, nil
+		} else if v.parts == 3 {
+			return comparatorSet{{op: "=", version: v.floor()}}, nil
+		}
+		return comparatorSet{{op: ">=", version: v.floor()}, {op: "<", version: zeroPreVersion(v.next(v.parts))}}, nil
+	case "!=":
+		if v.parts != 3 {
+			return nil, fmt.Errorf("operator != requires a full version")
+		}
+		return comparatorSet{{op: "!=", version: v.floor()}}, nil
+	case ">":
+		if v.parts == 0 {
+			return noVersion, nil
+		} else if v.parts == 3 {
+			return comparatorSet{{op: ">", version: v.floor()}}, nil
+		}
+		return comparatorSet{{op: ">=", version: v.next(v.parts)}}, nil
+	case ">=":
+		if v.parts == 0 {
+			return anyVersion, nil
+		}
+		return comparatorSet{{op: ">=", version: v.floor()}}, nil
+	case "<":
+		if v.parts == 0 {
+			return noVersion, nil
+		} else if v.parts == 3 {
+			return comparatorSet{{op: "<", version: v.floor()}}, nil
+		}
+		return comparatorSet{{op: "<", version: zeroPreVersion(v.floor())}}, nil
+	case "<=":
+		if v.parts == 0 {
+			return anyVersion, nil
+		} else if v.parts == 3 {
+			return comparatorSet{{op: "<=", version: v.floor()}}, nil
+		}
+		return comparatorSet{{op: "<", version: zeroPreVersion(v.next(v.parts))}}, nil
+	case "~":
+		if v.parts == 0 {
+			return anyVersion, nil
+		}
+		upper := v.next(2)
+		if v.parts == 1 {
+			upper = v.next(1)
+		}
+		return comparatorSet{{op: ">=", version: v.floor()}, {op: "<", version: zeroPreVersion(upper)}}, nil
+	case "^":
+		if v.parts == 0 {
+			return anyVersion, nil
+		}
+		// the first non-zero given part may not change
+		upper := v.next(1)
+		if v.major == 0 && v.parts >= 2 {
+			upper = v.next(2)
+			if v.minor == 0 && v.parts == 3 {
+				upper = v.next(3)
+			}
+		}
+		return comparatorSet{{op: ">=", version: v.floor()}, {op: "<", version: zeroPreVersion(upper)}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
+
+// returns the lowest version matching partial version
+func (v partialVersion) floor() semver.Version {
+	return semver.Version{Major: v.major, Minor: v.minor, Patch: v.patch, Pre: v.pre}
+}
+
+// returns the lowest release version, which is greater than all versions matching first n parts of v
+func (v partialVersion) next(n int) semver.Version {
+	switch n {
+	case 1:
+		return semver.Version{Major: v.major + 1}
+	case 2:
+		return semver.Version{Major: v.major, Minor: v.minor + 1}
+	}
+	return semver.Version{Major: v.major, Minor: v.minor, Patch: v.patch + 1}
+}
+
+// returns the lowest pre-release of version v, used for exclusive upper bounds, so that pre-releases
+// of the upper bound do not match
+func zeroPreVersion(v semver.Version) semver.Version {
+	v.Pre = []semver.PRVersion{{VersionNum: 0, IsNum: true}}
+	return v
+}
+
+func (s comparatorSet) matches(v semver.Version) bool {
+	for _, c := range s {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	if len(v.Pre) == 0 {
+		return true
+	}
+
+	// pre-release versions only match, if explicitly allowed by a comparator on the same version tuple
+	for _, c := range s {
+		if c.op != "" && len(c.version.Pre) > 0 && c.version.Major == v.Major &&
+			c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c versionComparator) matches(v semver.Version) bool {
+	switch c.op {
+	case "<":
+		return v.LT(c.version)
+	case "<=":
+		return v.LTE(c.version)
+	case ">":
+		return v.GT(c.version)
+	case ">=":
+		return v.GTE(c.version)
+	case "=":
+		return v.EQ(c.version)
+	case "!=":
+		return v.NE(c.version)
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+/*
+ *  Copyright (c) 2019 Kumuluz and/or its affiliates
+ *  and other contributors as indicated by the @author tags and
+ *  the contributor list.
+ *
+ *  Licensed under the MIT License (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *  https://opensource.org/licenses/MIT
+ *
+ *  The software is provided "AS IS", WITHOUT WARRANTY OF ANY KIND, express or
+ *  implied, including but not limited to the warranties of merchantability,
+ *  fitness for a particular purpose and noninfringement. in no event shall the
+ *  authors or copyright holders be liable for any claim, damages or other
+ *  liability, whether in an action of contract, tort or otherwise, arising from,
+ *  out of or in connection with the software or the use or other dealings in the
+ *  software. See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+// cases mirror the behaviour of npm's semver package (node-semver)
+func TestParseVersionRange(t *testing.T) {
+	tests := []struct {
+		versionRange string
+		version      string
+		matches      bool
+	}{
+		// any version, pre-releases excluded
+		{"*", "1.2.3", true},
+		{"*", "1.2.3-rc.1", false},
+		{"", "0.0.1", true},
+		{">=0.0.0", "2.0.0-rc.1", false},
+
+		// caret ranges, including 0.x rules
+		{"^1.2.3", "1.9.9", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^1.2.3", "2.0.0-rc.1", false},
+		{"^1.2.3-beta.2", "1.2.3-beta.4", true},
+		{"^1.2.3-beta.2", "1.2.4-beta.4", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"^0.0", "0.0.9", true},
+		{"^0.0", "0.1.0", false},
+		{"^0.x", "0.9.0", true},
+		{"^0.x", "1.0.0", false},
+		{"^1.x", "1.9.0", true},
+
+		// tilde ranges
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"~1", "2.0.0", false},
+		{"~> 1.2", "1.2.5", true},
+
+		// hyphen ranges
+		{"1.2 - 1.4", "1.4.9", true},
+		{"1.2 - 1.4", "1.5.0", false},
+		{"1.2 - 1.4", "1.1.9", false},
+		{"1.2.3 - 2.3.4", "2.3.4", true},
+		{"1.2.3 - 2.3.4", "2.3.5", false},
+
+		// unions
+		{"1.x || >=2.5.0", "2.6.0", true},
+		{"1.x || >=2.5.0", "2.4.0", false},
+		{"1.x || >=2.5.0", "1.0.0", true},
+
+		// x-ranges and partial versions
+		{"1.2.x", "1.2.7", true},
+		{"1.2.*", "1.3.0", false},
+		{"1.2", "1.2.3", true},
+		{"1", "1.9.3", true},
+		{">1.2", "1.2.9", false},
+		{">1.2", "1.3.0", true},
+		{"<1.2", "1.1.9", true},
+		{"<1.2", "1.2.0-rc", false},
+		{"<=1.2", "1.2.9", true},
+		{">*", "1.0.0", false},
+
+		// comparator sets
+		{">= 1.2.3 < 2", "1.9.0", true},
+		{">=1.0.0 <2.0.0 !1.5.0", "1.5.0", false},
+
+		// exact versions, build metadata is ignored
+		{"1.2.3", "1.2.3+build.5", true},
+		{"v1.2.3", "1.2.3", true},
+		{"1.2.3-rc.1", "1.2.3-rc.1", true},
+
+		// pre-releases only match comparators with the same major.minor.patch tuple
+		{">=2.0.0-rc.1", "2.0.0-rc.2", true},
+		{">=2.0.0-rc.1", "2.0.1-rc.2", false},
+		{">=2.0.0-rc.1", "2.0.1", true},
+	}
+
+	for _, test := range tests {
+		versionRange, err := parseVersion(test.versionRange)
+		if err != nil {
+			t.Errorf("parseVersion(%q) failed: %s", test.versionRange, err.Error())
+			continue
+		}
+		if matches := versionRange(semver.MustParse(test.version)); matches != test.matches {
+			t.Errorf("parseVersion(%q) matches %s = %v, want %v", test.versionRange, test.version, matches, test.matches)
+		}
+	}
+}
+
+func TestParseVersionRangeInvalid(t *testing.T) {
+	for _, versionRange := range []string{"1.2.3.4", "abc", "^1.2-rc", "!=1.2", "1.2.3 - x.y"} {
+		if _, err := parseVersion(versionRange); err == nil {
+			t.Errorf("parseVersion(%q) succeeded, want error", versionRange)
+		}
+	}
+}